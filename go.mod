@@ -1,6 +1,6 @@
 module prometheus-nvidiasmi
 
-go 1.15
+go 1.16
 
 require (
 	github.com/containerd/containerd v1.5.6 // indirect
@@ -8,5 +8,7 @@ require (
 	github.com/docker/go-connections v0.4.0 // indirect
 	github.com/morikuni/aec v1.0.0 // indirect
 	github.com/prometheus/common v0.17.0
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
+	gopkg.in/yaml.v3 v3.0.1
 )
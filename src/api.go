@@ -0,0 +1,347 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JSON API with the current state, for schedulers and other tools that do not want to parse
+// Prometheus metrics. Described in openapi.yaml, served at /api/v1/openapi.yaml.
+
+//go:embed openapi.yaml
+var openApiSpec []byte
+
+type apiHost struct {
+	Hostname      string            `json:"hostname"`
+	DriverVersion string            `json:"driver_version"`
+	CudaVersion   string            `json:"cuda_version"`
+	GpuCount      int               `json:"gpu_count"`
+	FreeGpuCount  int               `json:"free_gpu_count"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Updated       time.Time         `json:"updated"`
+}
+
+type apiGpu struct {
+	Index              int      `json:"index"`
+	UUID               string   `json:"uuid"`
+	PciBusId           string   `json:"pci_bus_id"`
+	Name               string   `json:"name"`
+	Serial             string   `json:"serial"`
+	MinorNumber        string   `json:"minor_number"`
+	ComputeMode        string   `json:"compute_mode"`
+	MemoryTotalBytes   *float64 `json:"memory_total_bytes"`
+	MemoryUsedBytes    *float64 `json:"memory_used_bytes"`
+	MemoryFreeBytes    *float64 `json:"memory_free_bytes"`
+	UtilizationPercent *float64 `json:"utilization_percent"`
+	TemperatureCelsius *float64 `json:"temperature_celsius"`
+	PowerDrawWatts     *float64 `json:"power_draw_watts"`
+	ProcessCount       int      `json:"process_count"`
+	ActionRequired     string   `json:"action_required,omitempty"`
+	Free               bool     `json:"free"`
+}
+
+type apiProcess struct {
+	Pid             int64    `json:"pid"`
+	GpuUUID         string   `json:"gpu_uuid"`
+	Type            string   `json:"type"`
+	Name            string   `json:"name"`
+	UsedMemoryBytes *float64 `json:"used_memory_bytes"`
+	StartTimestamp  float64  `json:"start_timestamp,omitempty"`
+	ContainerId     string   `json:"container_id,omitempty"`
+	ContainerName   string   `json:"container_name,omitempty"`
+}
+
+type apiContainer struct {
+	Id              string   `json:"id"`
+	Name            string   `json:"name"`
+	Image           string   `json:"image"`
+	StartTimestamp  float64  `json:"start_timestamp,omitempty"`
+	GpuUUIDs        []string `json:"gpu_uuids"`
+	Pids            []int64  `json:"pids"`
+	UsedMemoryBytes float64  `json:"used_memory_bytes"`
+}
+
+// query parameters, all optional
+type apiFilter struct {
+	uuids         map[string]bool // uuid=GPU-...&uuid=GPU-...
+	container     string          // container=<name or id prefix>, GPUs/processes of the container
+	minFreeMemory *float64        // min_free_memory=8GiB
+	free          *bool           // free=true
+}
+
+// query parameters supported by each endpoint
+var apiParameters = map[string][]string{
+	"hosts":      nil,
+	"gpus":       {"uuid", "container", "min_free_memory", "free"},
+	"processes":  {"uuid", "container"},
+	"containers": {"uuid", "container"},
+}
+
+var byteSizeRe = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*(B|KiB|MiB|GiB|TiB|K|M|G|T)$`)
+
+// "8GiB", "500MiB", "20G" (SI), "1024B", the unit is required
+func parseByteSize(s string) (float64, error) {
+	m := byteSizeRe.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q, expected a number with unit B, KiB, MiB, GiB, TiB, K, M, G or T, e.g. 8GiB", s)
+	}
+	value, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %v", s, err)
+	}
+	multiplier := map[string]float64{
+		"B":   1,
+		"KiB": 1 << 10,
+		"MiB": 1 << 20,
+		"GiB": 1 << 30,
+		"TiB": 1 << 40,
+		"K":   1e3,
+		"M":   1e6,
+		"G":   1e9,
+		"T":   1e12,
+	}[m[2]]
+	return value * multiplier, nil
+}
+
+func parseApiFilter(r *http.Request, endpoint string) (apiFilter, error) {
+	var f apiFilter
+	for key, values := range r.URL.Query() {
+		supported := false
+		for _, name := range apiParameters[endpoint] {
+			supported = supported || key == name
+		}
+		if !supported {
+			return f, fmt.Errorf("unknown parameter %q for /api/v1/%s", key, endpoint)
+		}
+		value := values[len(values)-1]
+		switch key {
+		case "uuid":
+			f.uuids = make(map[string]bool)
+			for _, uuid := range values {
+				f.uuids[uuid] = true
+			}
+		case "container":
+			f.container = value
+		case "min_free_memory":
+			v, err := parseByteSize(value)
+			if err != nil {
+				return f, fmt.Errorf("min_free_memory: %v", err)
+			}
+			f.minFreeMemory = &v
+		case "free":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return f, fmt.Errorf("invalid free %q, expected true or false", value)
+			}
+			f.free = &b
+		}
+	}
+	return f, nil
+}
+
+func (f apiFilter) matchContainer(info ProcessInfo) bool {
+	if f.container == "" {
+		return true
+	}
+	return info.containerId != "" && (info.containerName == f.container || strings.HasPrefix(info.containerId, f.container))
+}
+
+func optionalValue(value Value) *float64 {
+	if value.State != ValueOk {
+		return nil
+	}
+	return &value.Value
+}
+
+// processes of all GPUs, with names and containers from the process collector
+func apiProcesses(data *OutputData, f apiFilter) []apiProcess {
+	result := []apiProcess{}
+	for _, GPU := range data.nvidiaSmiOutput.GPU {
+		if f.uuids != nil && !f.uuids[GPU.UUID] {
+			continue
+		}
+		for _, process := range GPU.Processes.ProcessInfo {
+			info := data.processInfo[process.Pid]
+			if !f.matchContainer(info) {
+				continue
+			}
+			name := info.processName
+			if name == "" {
+				name = process.ProcessName
+			}
+			result = append(result, apiProcess{
+				Pid:             process.Pid,
+				GpuUUID:         GPU.UUID,
+				Type:            process.Type,
+				Name:            name,
+				UsedMemoryBytes: optionalValue(parseUnit(process.UsedMemory)),
+				StartTimestamp:  info.processStartTs,
+				ContainerId:     info.containerId,
+				ContainerName:   info.containerName,
+			})
+		}
+	}
+	return result
+}
+
+func apiGpus(data *OutputData, f apiFilter) []apiGpu {
+	// GPUs used by the container
+	var containerGpus map[string]bool
+	if f.container != "" {
+		containerGpus = make(map[string]bool)
+		for _, process := range apiProcesses(data, apiFilter{container: f.container}) {
+			containerGpus[process.GpuUUID] = true
+		}
+	}
+
+	result := []apiGpu{}
+	for i, GPU := range data.nvidiaSmiOutput.GPU {
+		gpu := apiGpu{
+			Index:              i,
+			UUID:               GPU.UUID,
+			PciBusId:           shortPciId(GPU.Id),
+			Name:               GPU.ProductName,
+			Serial:             GPU.Serial,
+			MinorNumber:        GPU.MinorNumber,
+			ComputeMode:        GPU.ComputeMode,
+			MemoryTotalBytes:   optionalValue(parseUnit(GPU.FbMemoryUsage.Total)),
+			MemoryUsedBytes:    optionalValue(parseUnit(GPU.FbMemoryUsage.Used)),
+			MemoryFreeBytes:    optionalValue(parseUnit(GPU.FbMemoryUsage.Free)),
+			UtilizationPercent: optionalValue(parseUnit(GPU.Utilization.GPUUtil)),
+			TemperatureCelsius: optionalValue(parseUnit(GPU.Temperature.GPUTemp)),
+			PowerDrawWatts:     optionalValue(parseUnit(GPU.GPUPowerReadings.PowerDraw)),
+			ProcessCount:       len(GPU.Processes.ProcessInfo),
+		}
+		if GPU.GPUPowerReadings.PowerState == "" {
+			// backwards compatibility
+			gpu.PowerDrawWatts = optionalValue(parseUnit(GPU.PowerReadings.PowerDraw))
+		}
+		if action, ok := gpuActionRequired(GPU); ok {
+			gpu.ActionRequired = action
+		}
+		// nothing running, no pending reset or replacement, and compute allowed
+		gpu.Free = gpu.ProcessCount == 0 &&
+			(gpu.ActionRequired == "" || gpu.ActionRequired == "none") &&
+			GPU.ComputeMode != "Prohibited"
+
+		switch {
+		case f.uuids != nil && !f.uuids[gpu.UUID]:
+		case containerGpus != nil && !containerGpus[gpu.UUID]:
+		case f.minFreeMemory != nil && (gpu.MemoryFreeBytes == nil || *gpu.MemoryFreeBytes < *f.minFreeMemory):
+		case f.free != nil && gpu.Free != *f.free:
+		default:
+			result = append(result, gpu)
+		}
+	}
+	return result
+}
+
+func apiContainers(data *OutputData, f apiFilter) []apiContainer {
+	byId := make(map[string]*apiContainer)
+	gpus := make(map[string]map[string]bool) // by container id
+	for _, process := range apiProcesses(data, f) {
+		if process.ContainerId == "" {
+			continue
+		}
+		c, ok := byId[process.ContainerId]
+		if !ok {
+			info := data.processInfo[process.Pid]
+			c = &apiContainer{
+				Id:             info.containerId,
+				Name:           info.containerName,
+				Image:          info.dockerImage,
+				StartTimestamp: info.containerStartTs,
+				GpuUUIDs:       []string{},
+			}
+			byId[process.ContainerId] = c
+			gpus[process.ContainerId] = make(map[string]bool)
+		}
+		if !gpus[c.Id][process.GpuUUID] {
+			gpus[c.Id][process.GpuUUID] = true
+			c.GpuUUIDs = append(c.GpuUUIDs, process.GpuUUID)
+		}
+		c.Pids = append(c.Pids, process.Pid)
+		if process.UsedMemoryBytes != nil {
+			c.UsedMemoryBytes += *process.UsedMemoryBytes
+		}
+	}
+
+	result := []apiContainer{}
+	for _, c := range byId {
+		result = append(result, *c)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
+
+// /api/v1/hosts, /api/v1/gpus, /api/v1/processes, /api/v1/containers
+func api(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/api/v1/openapi.yaml" {
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(openApiSpec)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "only GET requests allowed"})
+		return
+	}
+	endpoint := strings.TrimPrefix(r.URL.Path, "/api/v1/")
+	if _, ok := apiParameters[endpoint]; !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	f, err := parseApiFilter(r, endpoint)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	cfg := currentConfig()
+	collectForRequest(r, cfg, nil)
+	data := currentOutput()
+
+	switch endpoint {
+	case "hosts":
+		hostname, _ := os.Hostname()
+		host := apiHost{
+			Hostname:      hostname,
+			DriverVersion: data.nvidiaSmiOutput.DriverVersion,
+			CudaVersion:   data.nvidiaSmiOutput.CudaVersion,
+			Labels:        cfg.Labels.Static,
+			Updated:       data.updated,
+		}
+		for _, gpu := range apiGpus(data, apiFilter{}) {
+			host.GpuCount++
+			if gpu.Free {
+				host.FreeGpuCount++
+			}
+		}
+		// a list, so that responses of several exporters can be concatenated
+		writeJSON(w, http.StatusOK, []apiHost{host})
+	case "gpus":
+		writeJSON(w, http.StatusOK, apiGpus(data, f))
+	case "processes":
+		writeJSON(w, http.StatusOK, apiProcesses(data, f))
+	case "containers":
+		writeJSON(w, http.StatusOK, apiContainers(data, f))
+	}
+}
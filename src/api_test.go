@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in    string
+		value float64
+		ok    bool
+	}{
+		{"8GiB", 8 << 30, true},
+		{"500 MiB", 500 << 20, true},
+		{"1.5KiB", 1536, true},
+		{"2TiB", 2 << 40, true},
+		{"20G", 20e9, true},
+		{"3M", 3e6, true},
+		{"1024B", 1024, true},
+		{"8m", 0, false},
+		{"8", 0, false},
+		{"8mb", 0, false},
+		{"-1GiB", 0, false},
+		{"GiB", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		value, err := parseByteSize(tt.in)
+		if (err == nil) != tt.ok || value != tt.value {
+			t.Errorf("parseByteSize(%q) = %g, %v, want %g, ok %v", tt.in, value, err, tt.value, tt.ok)
+		}
+	}
+}
+
+func TestParseApiFilter(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		query    string
+		ok       bool
+	}{
+		{"hosts", "", true},
+		{"hosts", "uuid=GPU-1", false},
+		{"hosts", "free=true", false},
+		{"gpus", "uuid=GPU-1&uuid=GPU-2&container=web&min_free_memory=8GiB&free=true", true},
+		{"gpus", "min_free_memory=8m", false},
+		{"gpus", "free=maybe", false},
+		{"gpus", "foo=1", false},
+		{"processes", "uuid=GPU-1&container=web", true},
+		{"processes", "free=true", false},
+		{"containers", "min_free_memory=8GiB", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/v1/"+tt.endpoint+"?"+tt.query, nil)
+		_, err := parseApiFilter(r, tt.endpoint)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s?%s: error %v, want ok %v", tt.endpoint, tt.query, err, tt.ok)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/gpus?uuid=GPU-1&uuid=GPU-2&min_free_memory=8GiB&free=false", nil)
+	f, err := parseApiFilter(r, "gpus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.uuids["GPU-1"] || !f.uuids["GPU-2"] || len(f.uuids) != 2 {
+		t.Errorf("uuids %v", f.uuids)
+	}
+	if f.minFreeMemory == nil || *f.minFreeMemory != 8<<30 {
+		t.Errorf("min_free_memory %v", f.minFreeMemory)
+	}
+	if f.free == nil || *f.free {
+		t.Errorf("free %v", f.free)
+	}
+}
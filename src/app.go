@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"html"
 	"io"
 	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/common/log"
@@ -16,10 +23,39 @@ import (
 )
 
 var (
+	serveCommand = kingpin.Command(
+		"serve",
+		"Run the exporter (default)",
+	).Default()
+	checkConfigCommand = kingpin.Command(
+		"check-config",
+		"Validate the config file and exit",
+	)
+
+	configFile = kingpin.Flag(
+		"config-file",
+		"YAML config file, reloaded on SIGHUP or POST /-/reload (settings in it override flags)",
+	).String()
 	listenAddress = kingpin.Flag(
 		"listen",
-		"Address to listen on.",
+		"Address to listen on, or unix:/path/to/socket.",
 	).Default(":9202").String()
+	webConfigFile = kingpin.Flag(
+		"web.config.file",
+		"Web config file with TLS and basic auth/bearer token settings (exporter-toolkit format), reloaded with the config",
+	).String()
+	eventBufferSize = kingpin.Flag(
+		"events.buffer-size",
+		"Number of events kept for clients of /api/v1/events resuming with Last-Event-ID",
+	).Default("1000").Int()
+	eventTemperatureThreshold = kingpin.Flag(
+		"events.temperature-threshold",
+		"GPU temperature (Celsius) for temperature_above/below_threshold events, 0 to disable",
+	).Default("85").Float64()
+	enablePprof = kingpin.Flag(
+		"web.enable-pprof",
+		"Serve Go profiling data at /debug/pprof/",
+	).Bool()
 	nvidiaSmiPath = kingpin.Flag(
 		"nvidia-smi-path",
 		"Path to nvidia-smi",
@@ -28,68 +64,301 @@ var (
 		"gddr6-path",
 		"Path to gddr6",
 	).Default("/usr/local/bin/gddr6").String()
+	pciIdsPath = kingpin.Flag(
+		"pci-ids-path",
+		"Path to pci.ids database for PCI vendor/device names",
+	).Default("/usr/share/misc/pci.ids").String()
 	updateInterval = kingpin.Flag(
 		"update-interval",
 		"How often to run nvidia-smi",
 	).Default("5s").Duration()
+	collectionMode = kingpin.Flag(
+		"collection-mode",
+		"When to collect data: every --update-interval (interval) or when scraped (scrape)",
+	).Default("interval").Enum("interval", "scrape")
+	minRefreshInterval = kingpin.Flag(
+		"min-refresh-interval",
+		"In scrape mode, serve data collected less than this long ago without collecting again",
+	).Default("1s").Duration()
+	readyMaxAge = kingpin.Flag(
+		"ready-max-age",
+		"/-/ready fails if the data is older (default: 3 update intervals in interval mode, not checked in scrape mode)",
+	).Default("0s").Duration()
+	unsupportedAsZero = kingpin.Flag(
+		"unsupported-as-zero",
+		"Report N/A, [Not Supported] and [Unknown Error] readings as 0 instead of omitting them",
+	).Bool()
+	supportedClocks = kingpin.Flag(
+		"supported-clocks",
+		"Export supported memory/graphics clock pairs (large, hundreds of series per GPU)",
+	).Bool()
+	pcieLoadThreshold = kingpin.Flag(
+		"pcie-load-threshold",
+		"GPU utilization (percent) above which a PCIe link below its max speed/width is reported as degraded",
+	).Default("10").Float64()
+	gpuLabels = kingpin.Flag(
+		"gpu-label",
+		"Label identifying the GPU on per-GPU series, repeatable: gpu_id (PCI bus), gpu_uuid, gpu_index, gpu_minor_number, serial, gpu_name",
+	).Default("gpu_id").Enums(gpuIdentityLabelNames...)
+	staticLabels = kingpin.Flag(
+		"static-label",
+		"Label added to every series, repeatable, e.g. --static-label cluster=a",
+	).StringMap()
+	hostnameLabel = kingpin.Flag(
+		"hostname-label",
+		"Add a hostname label with the name of this host to every series",
+	).Bool()
+	// replaced by --collector.nvlink, --collector.nvswitch, --collector.conf_compute
+	nvLink = kingpin.Flag(
+		"nvlink",
+		"Same as --collector.nvlink",
+	).Hidden().Bool()
+	nvSwitch = kingpin.Flag(
+		"nvswitch",
+		"Same as --collector.nvswitch",
+	).Hidden().Bool()
+	confCompute = kingpin.Flag(
+		"conf-compute",
+		"Same as --collector.conf_compute",
+	).Hidden().Bool()
+	firmwarePolicyFile = kingpin.Flag(
+		"firmware-policy-file",
+		"JSON file with expected firmware/driver versions per product, enables firmware_compliant metrics",
+	).String()
 	testFile = kingpin.Flag(
 		"test-file",
 		"Run in test mode (read nvidia-smi xml output from specified file)",
 	).String()
+	testTopoFile = kingpin.Flag(
+		"test-topo-file",
+		"In test mode, read `nvidia-smi topo -m` output from specified file",
+	).String()
+	testNvLinkStatusFile = kingpin.Flag(
+		"test-nvlink-status-file",
+		"In test mode, read `nvidia-smi nvlink -s` output from specified file",
+	).String()
+	testNvLinkErrorsFile = kingpin.Flag(
+		"test-nvlink-errors-file",
+		"In test mode, read `nvidia-smi nvlink -e` output from specified file",
+	).String()
+	testNvLinkThroughputFile = kingpin.Flag(
+		"test-nvlink-throughput-file",
+		"In test mode, read `nvidia-smi nvlink -gt d` output from specified file",
+	).String()
+	testVgpuFile = kingpin.Flag(
+		"test-vgpu-file",
+		"In test mode, read `nvidia-smi vgpu -q` output from specified file",
+	).String()
+	testCcStatusFile = kingpin.Flag(
+		"test-cc-status-file",
+		"In test mode, read `nvidia-smi conf-compute -f` output from specified file",
+	).String()
+	testCcReadyStateFile = kingpin.Flag(
+		"test-cc-ready-state-file",
+		"In test mode, read `nvidia-smi conf-compute -grs` output from specified file",
+	).String()
+	testFabricManagerFile = kingpin.Flag(
+		"test-fabric-manager-file",
+		"In test mode, read `systemctl is-active nvidia-fabricmanager` output from specified file",
+	).String()
+	testKmsgFile = kingpin.Flag(
+		"test-kmsg-file",
+		"Read kernel log records for the xid collector from specified file instead of /dev/kmsg",
+	).String()
 )
 
 // read and store
 
 type OutputData struct {
 	nvidiaSmiOutput NvidiaSmiOutput
-	aerInfo         map[string]AerInfo    // by GPU Id
+	aerInfo         map[string]AerInfo        // by GPU Id
+	pciBridges      map[string][]string       // upstream bridges by GPU Id
+	bridgeAerInfo   map[string]AerInfo        // by bridge PCI Id
+	linkInfo        map[string]PciLinkInfo    // by GPU Id or bridge PCI Id
+	pciTopology     map[string]PciTopology    // by GPU Id
+	topology        map[string][]TopologyLink // by GPU Id
+	nvLinkInfo      NvLinkInfo
+	vgpuInfo        VgpuInfo
+	confCompute     ConfComputeInfo
+	nvSwitchInfo    []NvSwitchInfo
+	fabricManager   string                // service state
 	vendorInfo      map[string]VendorInfo // by GPU Id
 	processInfo     map[int64]ProcessInfo // by PID
 	temperatures    map[string]int        // by GPU Id
+	xidErrors       XidErrors
+	collectorStatus map[string]CollectorStatus
+	selected        map[string]bool // collectors run for collect[] params, nil: all due
+	updated         time.Time       // start of collection
 }
 
-var storedOutput OutputData
+var (
+	storedOutputMutex sync.RWMutex    // guards the pointer, stored data is not modified
+	storedOutput      = &OutputData{} // replaced by every successful collection
+	nvidiaSmiStatus   CollectorStatus // kept on failures, unlike storedOutput
+)
+
+// The latest data, for writing responses without holding storedOutputMutex
+func currentOutput() *OutputData {
+	storedOutputMutex.RLock()
+	defer storedOutputMutex.RUnlock()
+	return storedOutput
+}
 
-func readData() error {
-	var data OutputData
+// only called from updateData, never concurrently
+func readData(ctx context.Context, selected map[string]bool) error {
+	data := OutputData{selected: selected}
+	cfg := currentConfig()
+	data.updated = time.Now()
 
-	nvSmi, err := readNvidiaSmiOutput()
+	nvSmi, err := readNvidiaSmiOutput(ctx)
+	storedOutputMutex.Lock()
+	nvidiaSmiStatus.LastRun = data.updated
+	nvidiaSmiStatus.Duration = time.Since(data.updated)
+	nvidiaSmiStatus.Success = err == nil
+	nvidiaSmiStatus.Error = ""
+	if err != nil {
+		nvidiaSmiStatus.Error = err.Error()
+	} else {
+		nvidiaSmiStatus.LastSuccess = data.updated
+	}
+	storedOutputMutex.Unlock()
 	if err != nil {
 		return err
 	}
 	data.nvidiaSmiOutput = nvSmi
 
-	data.aerInfo = make(map[string]AerInfo)
-	data.vendorInfo = make(map[string]VendorInfo)
-	data.processInfo = make(map[int64]ProcessInfo)
+	// used by several collectors and for labels
+	data.pciBridges = make(map[string][]string)
+	for _, gpu := range nvSmi.GPU {
+		data.pciBridges[gpu.Id] = pciUpstreamBridges(gpu.Id)
+	}
+
+	data.collectorStatus = runCollectors(ctx, cfg, &data, currentOutput().collectorStatus, selected)
 
-	initial := storedOutput.vendorInfo == nil
-	if initial {
-		initVendorInfo()
-	} else {
-		data.vendorInfo = storedOutput.vendorInfo
+	storedOutputMutex.Lock()
+	prev := storedOutput
+	storedOutput = &data
+	storedOutputMutex.Unlock()
+	publishEvents(detectEvents(cfg, prev, &data))
+	return nil
+}
+
+type updateCall struct {
+	selected map[string]bool
+	done     chan struct{}
+	err      error
+	deadline time.Time   // latest deadline of the callers
+	timer    *time.Timer // cancels the collection at deadline, nil if a caller has no deadline
+}
+
+// Moves the deadline of the collection to the one of ctx if that is later
+func (call *updateCall) extend(ctx context.Context) {
+	if call.timer == nil {
+		return
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		call.timer.Stop()
+		call.timer = nil
+	} else if deadline.After(call.deadline) && call.timer.Stop() {
+		call.deadline = deadline
+		call.timer.Reset(time.Until(deadline))
 	}
+}
 
-	for _, gpu := range nvSmi.GPU {
-		data.aerInfo[gpu.Id] = aerInfo(gpu.Id)
-		if initial {
-			data.vendorInfo[gpu.Id] = vendorInfo(gpu.Id)
+var (
+	updateMutex   sync.Mutex
+	runningUpdate *updateCall
+)
+
+// true if collecting the collectors in a collects those in b, nil means all
+func collectorsCovered(a, b map[string]bool) bool {
+	if a == nil {
+		return true
+	}
+	if b == nil {
+		return false
+	}
+	for name := range b {
+		if !a[name] {
+			return false
 		}
-		for _, process := range gpu.Processes.ProcessInfo {
-			if _, ok := data.processInfo[process.Pid]; !ok {
-				data.processInfo[process.Pid] = processInfo(process.Pid)
-			}
+	}
+	return true
+}
+
+// Collects data unless the stored data is younger than maxAge. Concurrent calls are
+// coalesced into a single collection, which is aborted at the latest deadline of the callers'
+// contexts (not at all if one of them has none). If ctx is done before, the stored data is
+// left as it is and ctx.Err() is returned, the collection goes on in the background.
+// selected limits the collectors run, nil runs all that are due.
+func updateData(ctx context.Context, maxAge time.Duration, selected map[string]bool) error {
+	updateMutex.Lock()
+	// a collection of other collectors is not joined, but waited for
+	for runningUpdate != nil && !collectorsCovered(runningUpdate.selected, selected) {
+		call := runningUpdate
+		updateMutex.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
+		updateMutex.Lock()
 	}
+	call := runningUpdate
+	if call == nil {
+		if data := currentOutput(); time.Since(data.updated) < maxAge && collectorsCovered(data.selected, selected) {
+			updateMutex.Unlock()
+			return nil
+		}
 
-	temperatures, err := getGddr6Temperatures()
-	if err != nil {
-		return err
+		// not canceled together with ctx, other scrapes may be waiting for it
+		updateCtx, cancel := context.WithCancel(context.Background())
+		call = &updateCall{selected: selected, done: make(chan struct{})}
+		if deadline, ok := ctx.Deadline(); ok {
+			call.deadline = deadline
+			call.timer = time.AfterFunc(time.Until(deadline), cancel)
+		}
+		runningUpdate = call
+		go func() {
+			defer cancel()
+			err := readData(updateCtx, selected)
+			updateMutex.Lock()
+			if call.timer != nil {
+				call.timer.Stop()
+			}
+			runningUpdate = nil
+			call.err = err
+			updateMutex.Unlock()
+			close(call.done)
+		}()
+	} else {
+		call.extend(ctx)
 	}
-	data.temperatures = temperatures
+	updateMutex.Unlock()
 
-	storedOutput = data
-	return nil
+	select {
+	case <-call.done:
+		return call.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// left for writing the response when Prometheus aborts a scrape
+const scrapeTimeoutOffset = 500 * time.Millisecond
+
+// timeout of a Prometheus scrape request minus scrapeTimeoutOffset, 0 if unknown
+func scrapeTimeout(r *http.Request) time.Duration {
+	seconds, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > 2*scrapeTimeoutOffset {
+		timeout -= scrapeTimeoutOffset
+	}
+	return timeout
 }
 
 // output
@@ -100,6 +369,14 @@ func promEscape(value string) string {
 }
 
 func writeMetric(w http.ResponseWriter, name string, labelValues map[string]string, value string) {
+	name = "nvidiasmi_" + name
+	if filter, ok := w.(*filterWriter); ok {
+		var keep bool
+		if name, labelValues, keep = filter.apply(name, labelValues); !keep {
+			return
+		}
+	}
+
 	// make sorted array of keys to achieve a fixed order (otherwise the map iteration order is random each time)
 	labelKeys := make([]string, 0, len(labelValues))
 	for k := range labelValues {
@@ -118,12 +395,43 @@ func writeMetric(w http.ResponseWriter, name string, labelValues map[string]stri
 		meta = "{" + meta + "}"
 	}
 
-	io.WriteString(w, "nvidiasmi_"+name+meta+" "+value+"\n")
+	io.WriteString(w, name+meta+" "+value+"\n")
+}
+
+// In scrape mode, collects data for the request (or waits for a collection in progress).
+// selected limits the collectors run, nil runs all.
+func collectForRequest(r *http.Request, cfg *Config, selected map[string]bool) {
+	if cfg.CollectionMode != "scrape" {
+		return
+	}
+	ctx := r.Context()
+	if timeout := scrapeTimeout(r); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	// on errors the previous data is served, like in interval mode
+	if err := updateData(ctx, cfg.MinRefreshInterval, selected); err != nil {
+		log.Errorln("Error collecting data, serving previous data:", err)
+	}
 }
 
 func metrics(w http.ResponseWriter, r *http.Request) {
-	output := storedOutput.nvidiaSmiOutput
-	temperatures := storedOutput.temperatures
+	cfg := currentConfig()
+	filter, err := newFilterWriter(w, r, cfg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w = filter
+
+	// only the collectors needed for the collect[] params
+	collectForRequest(r, cfg, filter.selected)
+
+	data := currentOutput()
+	output := data.nvidiaSmiOutput
+	temperatures := data.temperatures
+	filter.setGpus(cfg, output.GPU)
 
 	// Output
 	labelValues := map[string]string{
@@ -133,100 +441,230 @@ func metrics(w http.ResponseWriter, r *http.Request) {
 	}
 	writeMetric(w, "info", labelValues, "1.0")
 
+	if cfg.collector("conf_compute").Enabled {
+		writeValue(w, "cc_mode_enabled", nil, parseEnabled(data.confCompute.Status))
+		if state := data.confCompute.ReadyState; state != "" {
+			// workloads cannot use the GPUs until they are attested and set ready
+			ready := "0"
+			if state == "ready" {
+				ready = "1"
+			}
+			writeMetric(w, "cc_gpu_ready", nil, ready)
+		}
+	}
+
 	for _, GPU := range output.GPU {
-		shortGpuId := strings.ToUpper(regexp.MustCompile(`^0{8}:`).ReplaceAllString(GPU.Id, ""))
+		shortGpuId := shortPciId(GPU.Id)
 		labelValues := map[string]string{"gpu_id": shortGpuId}
 
-		writeMetric(w, "pci_pcie_gen_max", labelValues, GPU.PCI.GPULinkInfo.PCIeGen.Max)
-		writeMetric(w, "pci_pcie_gen_current", labelValues, GPU.PCI.GPULinkInfo.PCIeGen.Current)
-		writeMetric(w, "pci_link_width_max_multiplicator", labelValues, filterNumber(GPU.PCI.GPULinkInfo.LinkWidth.Max))
-		writeMetric(w, "pci_link_width_current_multiplicator", labelValues, filterNumber(GPU.PCI.GPULinkInfo.LinkWidth.Current))
-		writeMetric(w, "pci_replay_counter", labelValues, GPU.PCI.ReplayRolloverCounter)
-		writeMetric(w, "pci_replay_rollover_counter", labelValues, GPU.PCI.ReplayRolloverCounter)
-		writeMetric(w, "pci_tx_util_bytes_per_second", labelValues, filterUnit(GPU.PCI.TxUtil))
-		writeMetric(w, "pci_rx_util_bytes_per_second", labelValues, filterUnit(GPU.PCI.RxUtil))
-		writeMetric(w, "fan_speed_percent", labelValues, filterUnit(GPU.FanSpeed))
-		writeMetric(w, "performance_state_int", labelValues, filterNumber(GPU.PerformanceState))
-		writeMetric(w, "fb_memory_usage_total_bytes", labelValues, filterUnit(GPU.FbMemoryUsage.Total))
-		writeMetric(w, "fb_memory_usage_used_bytes", labelValues, filterUnit(GPU.FbMemoryUsage.Used))
-		writeMetric(w, "fb_memory_usage_free_bytes", labelValues, filterUnit(GPU.FbMemoryUsage.Free))
-		writeMetric(w, "bar1_memory_usage_total_bytes", labelValues, filterUnit(GPU.Bar1MemoryUsage.Total))
-		writeMetric(w, "bar1_memory_usage_used_bytes", labelValues, filterUnit(GPU.Bar1MemoryUsage.Used))
-		writeMetric(w, "bar1_memory_usage_free_bytes", labelValues, filterUnit(GPU.Bar1MemoryUsage.Free))
-		writeMetric(w, "utilization_gpu_percent", labelValues, filterUnit(GPU.Utilization.GPUUtil))
-		writeMetric(w, "utilization_memory_percent", labelValues, filterUnit(GPU.Utilization.MemoryUtil))
-		writeMetric(w, "utilization_encoder_percent", labelValues, filterUnit(GPU.Utilization.EncoderUtil))
-		writeMetric(w, "utilization_decoder_percent", labelValues, filterUnit(GPU.Utilization.DecoderUtil))
-		writeMetric(w, "encoder_session_count", labelValues, GPU.EncoderStats.SessionCount)
-		writeMetric(w, "encoder_average_fps", labelValues, GPU.EncoderStats.AverageFPS)
-		writeMetric(w, "encoder_average_latency", labelValues, GPU.EncoderStats.AverageLatency)
-		writeMetric(w, "fbc_session_count", labelValues, GPU.FBCStats.SessionCount)
-		writeMetric(w, "fbc_average_fps", labelValues, GPU.FBCStats.AverageFPS)
-		writeMetric(w, "fbc_average_latency", labelValues, GPU.FBCStats.AverageLatency)
-		writeMetric(w, "gpu_temp_celsius", labelValues, filterUnit(GPU.Temperature.GPUTemp))
-		writeMetric(w, "gpu_temp_max_threshold_celsius", labelValues, filterUnit(GPU.Temperature.GPUTempMaxThreshold))
-		writeMetric(w, "gpu_temp_slow_threshold_celsius", labelValues, filterUnit(GPU.Temperature.GPUTempSlowThreshold))
-		writeMetric(w, "gpu_temp_max_gpu_threshold_celsius", labelValues, filterUnit(GPU.Temperature.GPUTempMaxGpuThreshold))
-		writeMetric(w, "gpu_target_temp_celsius", labelValues, filterUnit(GPU.Temperature.GPUTargetTemperature))
-		writeMetric(w, "gpu_target_temp_min_celsius", labelValues, filterUnit(GPU.SupportedGPUTargetTemp.GPUTargetTempMin))
-		writeMetric(w, "gpu_target_temp_max_celsius", labelValues, filterUnit(GPU.SupportedGPUTargetTemp.GPUTargetTempMax))
-		memoryTemp := filterUnit(GPU.Temperature.MemoryTemp)
-		if memoryTemp == "0" && temperatures != nil {
-			memoryTemp = fmt.Sprintf("%d", temperatures[shortGpuId])
-		}
-		writeMetric(w, "memory_temp_celsius", labelValues, memoryTemp)
-		writeMetric(w, "gpu_temp_max_mem_threshold_celsius", labelValues, filterUnit(GPU.Temperature.GPUTempMaxMemThreshold))
+		writeValue(w, "pci_pcie_gen_max", labelValues, parseNumber(GPU.PCI.GPULinkInfo.PCIeGen.Max))
+		writeValue(w, "pci_pcie_gen_current", labelValues, parseNumber(GPU.PCI.GPULinkInfo.PCIeGen.Current))
+		writeValue(w, "pci_link_width_max_multiplicator", labelValues, parseNumber(GPU.PCI.GPULinkInfo.LinkWidth.Max))
+		writeValue(w, "pci_link_width_current_multiplicator", labelValues, parseNumber(GPU.PCI.GPULinkInfo.LinkWidth.Current))
+		writeValue(w, "pci_replay_counter", labelValues, parseNumber(GPU.PCI.ReplayCounter))
+		writeValue(w, "pci_replay_rollover_counter", labelValues, parseNumber(GPU.PCI.ReplayRolloverCounter))
+		writeValue(w, "pci_tx_util_bytes_per_second", labelValues, parseUnit(GPU.PCI.TxUtil))
+		writeValue(w, "pci_rx_util_bytes_per_second", labelValues, parseUnit(GPU.PCI.RxUtil))
+		writeValue(w, "fan_speed_percent", labelValues, parseUnit(GPU.FanSpeed))
+		writeValue(w, "performance_state_int", labelValues, parseNumber(GPU.PerformanceState))
+		writeValue(w, "fb_memory_usage_total_bytes", labelValues, parseUnit(GPU.FbMemoryUsage.Total))
+		writeValue(w, "fb_memory_usage_used_bytes", labelValues, parseUnit(GPU.FbMemoryUsage.Used))
+		writeValue(w, "fb_memory_usage_free_bytes", labelValues, parseUnit(GPU.FbMemoryUsage.Free))
+		writeValue(w, "bar1_memory_usage_total_bytes", labelValues, parseUnit(GPU.Bar1MemoryUsage.Total))
+		writeValue(w, "bar1_memory_usage_used_bytes", labelValues, parseUnit(GPU.Bar1MemoryUsage.Used))
+		writeValue(w, "bar1_memory_usage_free_bytes", labelValues, parseUnit(GPU.Bar1MemoryUsage.Free))
+		// same values under one metric, with confidential computing protected memory
+		pools := []struct{ name, total, used, free string }{
+			{"fb", GPU.FbMemoryUsage.Total, GPU.FbMemoryUsage.Used, GPU.FbMemoryUsage.Free},
+			{"bar1", GPU.Bar1MemoryUsage.Total, GPU.Bar1MemoryUsage.Used, GPU.Bar1MemoryUsage.Free},
+		}
+		// reported as 0 MiB without CC, which would look like an exhausted pool
+		ccTotal := parseUnit(GPU.CcProtectedMemoryUsage.Total)
+		ccEnabled := parseEnabled(data.confCompute.Status)
+		if ccTotal.State == ValueOk && ccTotal.Value > 0 || ccEnabled.State == ValueOk && ccEnabled.Value == 1 {
+			pools = append(pools, struct{ name, total, used, free string }{
+				"cc_protected", GPU.CcProtectedMemoryUsage.Total, GPU.CcProtectedMemoryUsage.Used, GPU.CcProtectedMemoryUsage.Free,
+			})
+		}
+		for _, pool := range pools {
+			labelValues["pool"] = pool.name
+			writeValue(w, "memory_usage_total_bytes", labelValues, parseUnit(pool.total))
+			writeValue(w, "memory_usage_used_bytes", labelValues, parseUnit(pool.used))
+			writeValue(w, "memory_usage_free_bytes", labelValues, parseUnit(pool.free))
+		}
+		labelValues["pool"] = "fb"
+		writeValue(w, "memory_usage_reserved_bytes", labelValues, parseUnit(GPU.FbMemoryUsage.Reserved))
+		delete(labelValues, "pool")
+		writeValue(w, "utilization_gpu_percent", labelValues, parseUnit(GPU.Utilization.GPUUtil))
+		writeValue(w, "utilization_memory_percent", labelValues, parseUnit(GPU.Utilization.MemoryUtil))
+		writeValue(w, "utilization_encoder_percent", labelValues, parseUnit(GPU.Utilization.EncoderUtil))
+		writeValue(w, "utilization_decoder_percent", labelValues, parseUnit(GPU.Utilization.DecoderUtil))
+		writeValue(w, "utilization_jpeg_percent", labelValues, parseUnit(GPU.Utilization.JpegUtil))
+		writeValue(w, "utilization_ofa_percent", labelValues, parseUnit(GPU.Utilization.OfaUtil))
+		// same values under one metric, so engines can be compared and summed in one query
+		for _, e := range [][2]string{
+			{"gpu", GPU.Utilization.GPUUtil},
+			{"memory", GPU.Utilization.MemoryUtil},
+			{"encoder", GPU.Utilization.EncoderUtil},
+			{"decoder", GPU.Utilization.DecoderUtil},
+			{"jpeg", GPU.Utilization.JpegUtil},
+			{"ofa", GPU.Utilization.OfaUtil},
+		} {
+			labelValues["engine"] = e[0]
+			writeValue(w, "engine_utilization_percent", labelValues, parseUnit(e[1]))
+		}
+		delete(labelValues, "engine")
+		writeValue(w, "encoder_session_count", labelValues, parseNumber(GPU.EncoderStats.SessionCount))
+		writeValue(w, "encoder_average_fps", labelValues, parseNumber(GPU.EncoderStats.AverageFPS))
+		writeValue(w, "encoder_average_latency", labelValues, parseNumber(GPU.EncoderStats.AverageLatency))
+		writeValue(w, "fbc_session_count", labelValues, parseNumber(GPU.FBCStats.SessionCount))
+		writeValue(w, "fbc_average_fps", labelValues, parseNumber(GPU.FBCStats.AverageFPS))
+		writeValue(w, "fbc_average_latency", labelValues, parseNumber(GPU.FBCStats.AverageLatency))
+		writeValue(w, "gpu_temp_celsius", labelValues, parseUnit(GPU.Temperature.GPUTemp))
+		writeValue(w, "gpu_temp_max_threshold_celsius", labelValues, parseUnit(GPU.Temperature.GPUTempMaxThreshold))
+		writeValue(w, "gpu_temp_slow_threshold_celsius", labelValues, parseUnit(GPU.Temperature.GPUTempSlowThreshold))
+		writeValue(w, "gpu_temp_max_gpu_threshold_celsius", labelValues, parseUnit(GPU.Temperature.GPUTempMaxGpuThreshold))
+		// Ada and later report temperature relative to T.Limit instead of absolute thresholds:
+		// margin is degrees below the limit, thresholds are margin values at which the GPU
+		// slows down or shuts down (negative = above the limit)
+		writeValue(w, "gpu_temp_tlimit_margin_celsius", labelValues, parseUnit(GPU.Temperature.GPUTempTLimit))
+		writeValue(w, "gpu_temp_max_tlimit_threshold_celsius", labelValues, parseUnit(GPU.Temperature.GPUTempMaxTLimitThreshold))
+		writeValue(w, "gpu_temp_slow_tlimit_threshold_celsius", labelValues, parseUnit(GPU.Temperature.GPUTempSlowTLimitThreshold))
+		writeValue(w, "gpu_temp_max_gpu_tlimit_threshold_celsius", labelValues, parseUnit(GPU.Temperature.GPUTempMaxGpuTLimitThreshold))
+		writeValue(w, "gpu_temp_max_mem_tlimit_threshold_celsius", labelValues, parseUnit(GPU.Temperature.GPUTempMaxMemTLimitThreshold))
+		writeValue(w, "gpu_target_temp_celsius", labelValues, parseUnit(GPU.Temperature.GPUTargetTemperature))
+		writeValue(w, "gpu_target_temp_min_celsius", labelValues, parseUnit(GPU.SupportedGPUTargetTemp.GPUTargetTempMin))
+		writeValue(w, "gpu_target_temp_max_celsius", labelValues, parseUnit(GPU.SupportedGPUTargetTemp.GPUTargetTempMax))
+		memoryTemp := parseUnit(GPU.Temperature.MemoryTemp)
+		if t, ok := temperatures[shortGpuId]; ok && memoryTemp.State != ValueOk {
+			// from gddr6 tool
+			memoryTemp = Value{Value: float64(t)}
+		}
+		writeValue(w, "memory_temp_celsius", labelValues, memoryTemp)
+		writeValue(w, "gpu_temp_max_mem_threshold_celsius", labelValues, parseUnit(GPU.Temperature.GPUTempMaxMemThreshold))
 		if GPU.GPUPowerReadings.PowerState != "" {
-			writeMetric(w, "power_state_int", labelValues, filterNumber(GPU.GPUPowerReadings.PowerState))
-			writeMetric(w, "power_draw_watts", labelValues, filterUnit(GPU.GPUPowerReadings.PowerDraw))
-			writeMetric(w, "power_limit_watts", labelValues, filterUnit(GPU.GPUPowerReadings.CurrentPowerLimit))
-			writeMetric(w, "requested_power_limit_watts", labelValues, filterUnit(GPU.GPUPowerReadings.RequestedPowerLimit))
-			writeMetric(w, "default_power_limit_watts", labelValues, filterUnit(GPU.GPUPowerReadings.DefaultPowerLimit))
-			writeMetric(w, "min_power_limit_watts", labelValues, filterUnit(GPU.PowerReadings.MinPowerLimit))
-			writeMetric(w, "max_power_limit_watts", labelValues, filterUnit(GPU.PowerReadings.MaxPowerLimit))
+			writeValue(w, "power_state_int", labelValues, parseNumber(GPU.GPUPowerReadings.PowerState))
+			writeValue(w, "power_draw_watts", labelValues, parseUnit(GPU.GPUPowerReadings.PowerDraw))
+			writeValue(w, "power_limit_watts", labelValues, parseUnit(GPU.GPUPowerReadings.CurrentPowerLimit))
+			writeValue(w, "requested_power_limit_watts", labelValues, parseUnit(GPU.GPUPowerReadings.RequestedPowerLimit))
+			writeValue(w, "default_power_limit_watts", labelValues, parseUnit(GPU.GPUPowerReadings.DefaultPowerLimit))
+			writeValue(w, "min_power_limit_watts", labelValues, parseUnit(GPU.GPUPowerReadings.MinPowerLimit))
+			writeValue(w, "max_power_limit_watts", labelValues, parseUnit(GPU.GPUPowerReadings.MaxPowerLimit))
 		} else if GPU.PowerReadings.PowerState != "" {
 			// backwards compatibility
-			writeMetric(w, "power_state_int", labelValues, filterNumber(GPU.PowerReadings.PowerState))
-			writeMetric(w, "power_draw_watts", labelValues, filterUnit(GPU.PowerReadings.PowerDraw))
-			writeMetric(w, "power_limit_watts", labelValues, filterUnit(GPU.PowerReadings.PowerLimit))
-			writeMetric(w, "default_power_limit_watts", labelValues, filterUnit(GPU.PowerReadings.DefaultPowerLimit))
-			writeMetric(w, "enforced_power_limit_watts", labelValues, filterUnit(GPU.PowerReadings.EnforcedPowerLimit))
-			writeMetric(w, "min_power_limit_watts", labelValues, filterUnit(GPU.PowerReadings.MinPowerLimit))
-			writeMetric(w, "max_power_limit_watts", labelValues, filterUnit(GPU.PowerReadings.MaxPowerLimit))
-		}
-		writeMetric(w, "clock_graphics_hertz", labelValues, filterUnit(GPU.Clocks.GraphicsClock))
-		writeMetric(w, "clock_graphics_max_hertz", labelValues, filterUnit(GPU.MaxClocks.GraphicsClock))
-		writeMetric(w, "clock_sm_hertz", labelValues, filterUnit(GPU.Clocks.SmClock))
-		writeMetric(w, "clock_sm_max_hertz", labelValues, filterUnit(GPU.MaxClocks.SmClock))
-		writeMetric(w, "clock_mem_hertz", labelValues, filterUnit(GPU.Clocks.MemClock))
-		writeMetric(w, "clock_mem_max_hertz", labelValues, filterUnit(GPU.MaxClocks.MemClock))
-		writeMetric(w, "clock_video_hertz", labelValues, filterUnit(GPU.Clocks.VideoClock))
-		writeMetric(w, "clock_video_max_hertz", labelValues, filterUnit(GPU.MaxClocks.VideoClock))
-		writeMetric(w, "clock_policy_auto_boost", labelValues, filterUnit(GPU.ClockPolicy.AutoBoost))
-		writeMetric(w, "clock_policy_auto_boost_default", labelValues, filterUnit(GPU.ClockPolicy.AutoBoostDefault))
-		writeMetric(w, "clocks_throttle_reason_gpu_idle", labelValues, filterActive(GPU.ClockThrottleReasons.ClockThrottleReasonGPUIdle))
-		writeMetric(w, "clocks_throttle_reason_applications_clocks_setting", labelValues, filterActive(GPU.ClockThrottleReasons.ClockThrottleReasonApplicationsClocksSetting))
-		writeMetric(w, "clocks_throttle_reason_sw_power_cap", labelValues, filterActive(GPU.ClockThrottleReasons.ClockThrottleReasonSWPowerCap))
-		writeMetric(w, "clocks_throttle_reason_hw_slowdown", labelValues, filterActive(GPU.ClockThrottleReasons.ClockThrottleReasonHWSlowdown))
-		writeMetric(w, "clocks_throttle_reason_hw_thermal_slowdown", labelValues, filterActive(GPU.ClockThrottleReasons.ClockThrottleReasonHWThermalSlowdown))
-		writeMetric(w, "clocks_throttle_reason_hw_power_brake_slowdown", labelValues, filterActive(GPU.ClockThrottleReasons.ClockThrottleReasonHWPowerBrakeSlowdown))
-		writeMetric(w, "clocks_throttle_reason_sync_boost", labelValues, filterActive(GPU.ClockThrottleReasons.ClockThrottleReasonSyncBoost))
-		writeMetric(w, "clocks_throttle_reason_sw_thermal_slowdown", labelValues, filterActive(GPU.ClockThrottleReasons.ClockThrottleReasonSWThermalSlowdown))
-		writeMetric(w, "clocks_throttle_reason_display_clocks_setting", labelValues, filterActive(GPU.ClockThrottleReasons.ClockThrottleReasonDisplayClocksSetting))
-
-		aer := storedOutput.aerInfo[GPU.Id]
-		labelValues["aer_type"] = "fatal"
-		writeMetric(w, "aer_counter", labelValues, strconv.Itoa(aer.AerFatalCount))
-		labelValues["aer_type"] = "non-fatal"
-		writeMetric(w, "aer_counter", labelValues, strconv.Itoa(aer.AerNonFatalCount))
-		labelValues["aer_type"] = "correctable"
-		writeMetric(w, "aer_counter", labelValues, strconv.Itoa(aer.AerCorrectableCount))
-		delete(labelValues, "aer_type")
+			writeValue(w, "power_state_int", labelValues, parseNumber(GPU.PowerReadings.PowerState))
+			writeValue(w, "power_draw_watts", labelValues, parseUnit(GPU.PowerReadings.PowerDraw))
+			writeValue(w, "power_limit_watts", labelValues, parseUnit(GPU.PowerReadings.PowerLimit))
+			writeValue(w, "default_power_limit_watts", labelValues, parseUnit(GPU.PowerReadings.DefaultPowerLimit))
+			writeValue(w, "enforced_power_limit_watts", labelValues, parseUnit(GPU.PowerReadings.EnforcedPowerLimit))
+			writeValue(w, "min_power_limit_watts", labelValues, parseUnit(GPU.PowerReadings.MinPowerLimit))
+			writeValue(w, "max_power_limit_watts", labelValues, parseUnit(GPU.PowerReadings.MaxPowerLimit))
+		}
+		// component only on memory and module series, GPU series keep their labels
+		labelValues["component"] = "memory"
+		writeValue(w, "power_draw_watts", labelValues, parseUnit(GPU.GPUMemoryPowerReadings.PowerDraw))
+		// whole board/module (e.g. Grace Hopper), N/A on most GPUs
+		if fieldState(GPU.ModulePowerReadings.PowerDraw) == ValueOk {
+			labelValues["component"] = "module"
+			writeValue(w, "power_draw_watts", labelValues, parseUnit(GPU.ModulePowerReadings.PowerDraw))
+			writeValue(w, "power_limit_watts", labelValues, parseUnit(GPU.ModulePowerReadings.CurrentPowerLimit))
+			writeValue(w, "requested_power_limit_watts", labelValues, parseUnit(GPU.ModulePowerReadings.RequestedPowerLimit))
+			writeValue(w, "default_power_limit_watts", labelValues, parseUnit(GPU.ModulePowerReadings.DefaultPowerLimit))
+			writeValue(w, "min_power_limit_watts", labelValues, parseUnit(GPU.ModulePowerReadings.MinPowerLimit))
+			writeValue(w, "max_power_limit_watts", labelValues, parseUnit(GPU.ModulePowerReadings.MaxPowerLimit))
+		}
+		delete(labelValues, "component")
+		writeValue(w, "graphics_voltage_volts", labelValues, parseUnit(GPU.Voltage.GraphicsVolt))
+		writeValue(w, "clock_graphics_hertz", labelValues, parseUnit(GPU.Clocks.GraphicsClock))
+		writeValue(w, "clock_graphics_max_hertz", labelValues, parseUnit(GPU.MaxClocks.GraphicsClock))
+		writeValue(w, "clock_sm_hertz", labelValues, parseUnit(GPU.Clocks.SmClock))
+		writeValue(w, "clock_sm_max_hertz", labelValues, parseUnit(GPU.MaxClocks.SmClock))
+		writeValue(w, "clock_mem_hertz", labelValues, parseUnit(GPU.Clocks.MemClock))
+		writeValue(w, "clock_mem_max_hertz", labelValues, parseUnit(GPU.MaxClocks.MemClock))
+		writeValue(w, "clock_video_hertz", labelValues, parseUnit(GPU.Clocks.VideoClock))
+		writeValue(w, "clock_video_max_hertz", labelValues, parseUnit(GPU.MaxClocks.VideoClock))
+		writeValue(w, "clock_applications_graphics_hertz", labelValues, parseUnit(GPU.ApplicationsClocks.GraphicsClock))
+		writeValue(w, "clock_applications_mem_hertz", labelValues, parseUnit(GPU.ApplicationsClocks.MemClock))
+		writeValue(w, "clock_default_applications_graphics_hertz", labelValues, parseUnit(GPU.DefaultApplicationsClocks.GraphicsClock))
+		writeValue(w, "clock_default_applications_mem_hertz", labelValues, parseUnit(GPU.DefaultApplicationsClocks.MemClock))
+		writeValue(w, "clock_deferred_mem_hertz", labelValues, parseUnit(GPU.DeferredClocks.MemClock))
+		writeValue(w, "clock_max_customer_boost_graphics_hertz", labelValues, parseUnit(GPU.MaxCustomerBoostClocks.GraphicsClock))
+		if cfg.Metrics.SupportedClocks {
+			for _, mem := range GPU.SupportedClocks.SupportedMemClock {
+				memClock := parseUnit(mem.Value)
+				for _, graphics := range mem.SupportedGraphicsClock {
+					graphicsClock := parseUnit(graphics)
+					if memClock.State != ValueOk || graphicsClock.State != ValueOk {
+						continue
+					}
+					labelValues2 := map[string]string{
+						"gpu_id":               labelValues["gpu_id"],
+						"mem_clock_hertz":      strconv.FormatFloat(memClock.Value, 'f', -1, 64),
+						"graphics_clock_hertz": strconv.FormatFloat(graphicsClock.Value, 'f', -1, 64),
+					}
+					writeMetric(w, "supported_clock_info", labelValues2, "1.0")
+				}
+			}
+		}
+		writeValue(w, "clock_policy_auto_boost", labelValues, parseEnabled(GPU.ClockPolicy.AutoBoost))
+		writeValue(w, "clock_policy_auto_boost_default", labelValues, parseEnabled(GPU.ClockPolicy.AutoBoostDefault))
+		reasons := GPU.clockReasons()
+		for _, name := range clockReasonNames {
+			writeValue(w, "clocks_throttle_reason_"+name, labelValues, parseActive(reasons[name]))
+		}
+
+		writeAerMetrics(w, "", labelValues, data.aerInfo[GPU.Id])
+		for _, bridge := range data.pciBridges[GPU.Id] {
+			labelValues["bridge_id"] = shortPciId(bridge)
+			writeAerMetrics(w, "bridge_", labelValues, data.bridgeAerInfo[bridge])
+		}
+		delete(labelValues, "bridge_id")
+		writeXidMetrics(w, labelValues, data.xidErrors[shortGpuId])
+
+		writeLinkMetrics(w, data, labelValues, GPU.Id, parseUnit(GPU.Utilization.GPUUtil))
+		writeTopologyMetrics(w, data, labelValues, GPU.Id)
+		writeNvLinkMetrics(w, data, labelValues, GPU.UUID)
+		writeVgpuMetrics(w, data, labelValues, GPU.Id)
+
+		if fieldState(GPU.Fabric.State) == ValueOk && GPU.Fabric.State != "Not Supported" {
+			labelValues2 := map[string]string{
+				"gpu_id":       labelValues["gpu_id"],
+				"clique_id":    GPU.Fabric.CliqueId,
+				"cluster_uuid": GPU.Fabric.ClusterUuid,
+				"bandwidth":    GPU.Fabric.Health.Bandwidth,
+			}
+			writeMetric(w, "fabric_info", labelValues2, "1.0")
+			fabricState := "Unknown"
+			for _, state := range fabricStates {
+				if GPU.Fabric.State == state {
+					fabricState = state
+				}
+			}
+			for _, state := range fabricStates {
+				value := "0"
+				if state == fabricState {
+					value = "1"
+				}
+				labelValues["state"] = state
+				writeMetric(w, "fabric_state", labelValues, value)
+			}
+			delete(labelValues, "state")
+			// GPUs cannot run CUDA workloads until the fabric manager has registered them
+			ready := "0"
+			if GPU.Fabric.State == "Completed" && GPU.Fabric.Status == "Success" {
+				ready = "1"
+			}
+			writeMetric(w, "fabric_ready", labelValues, ready)
+		}
+
+		writeDeviceStateMetrics(w, labelValues, GPU)
+		writeFirmwareMetrics(w, labelValues, output.DriverVersion, GPU)
+		writeResetMetrics(w, labelValues, GPU)
 
 		labelValues["gpu_uuid"] = GPU.UUID
 		labelValues["gpu_name"] = GPU.ProductName
 		labelValues["serial"] = GPU.Serial
-		vendor := storedOutput.vendorInfo[GPU.Id]
+		vendor := data.vendorInfo[GPU.Id]
 		labelValues["vendor"] = vendor.Vendor
 		labelValues["device"] = vendor.Device
 		labelValues["subsys_vendor"] = vendor.SubsysVendor
@@ -240,11 +678,34 @@ func metrics(w http.ResponseWriter, r *http.Request) {
 				"process_type": Process.Type,
 			}
 			writeMetric(w, "process_up", labelValues2, "1.0")
-			writeMetric(w, "process_used_memory_bytes", labelValues2, filterUnit(Process.UsedMemory))
+			writeValue(w, "process_used_memory_bytes", labelValues2, parseUnit(Process.UsedMemory))
 		}
 	}
 
-	for pid, pInfo := range storedOutput.processInfo {
+	if cfg.collector("nvswitch").Enabled {
+		for _, sw := range data.nvSwitchInfo {
+			labelValues := map[string]string{"nvswitch_id": shortPciId(sw.Id)}
+			writeAerMetrics(w, "nvswitch_", labelValues, sw.Aer)
+			labelValues["vendor"] = sw.Vendor.Vendor
+			labelValues["device"] = sw.Vendor.Device
+			writeMetric(w, "nvswitch_info", labelValues, "1.0")
+		}
+		// one series per state, so a state change does not start new series
+		for _, state := range fabricManagerStates {
+			value := "0"
+			if data.fabricManager == state {
+				value = "1"
+			}
+			writeMetric(w, "fabric_manager_state", map[string]string{"state": state}, value)
+		}
+		active := "0"
+		if data.fabricManager == "active" {
+			active = "1"
+		}
+		writeMetric(w, "fabric_manager_active", nil, active)
+	}
+
+	for pid, pInfo := range data.processInfo {
 		labelValues := map[string]string{
 			"pid": fmt.Sprintf("%d", pid),
 		}
@@ -263,10 +724,397 @@ func metrics(w http.ResponseWriter, r *http.Request) {
 
 		writeMetric(w, "process_info", labelValues, "1.0")
 	}
+
+	for _, name := range collectorNames() {
+		status, ok := data.collectorStatus[name]
+		if !ok || !filter.collectorSelected(name) {
+			// disabled or not requested
+			continue
+		}
+		labelValues := map[string]string{"collector": name}
+		success := "0"
+		if status.Success {
+			success = "1"
+		}
+		writeMetric(w, "collector_success", labelValues, success)
+		writeMetric(w, "collector_duration_seconds", labelValues, fmt.Sprintf("%f", status.Duration.Seconds()))
+	}
+}
+
+// Readings that are not available are reported as 0 with --unsupported-as-zero, otherwise
+// omitted and listed once per GPU in field_unsupported, so that 0 can be told from "can't measure".
+// Fields missing in the running nvidia-smi version are skipped silently.
+func writeValue(w http.ResponseWriter, name string, labelValues map[string]string, value Value) {
+	switch value.State {
+	case ValueOk:
+		writeMetric(w, name, labelValues, value.String())
+	case ValueAbsent:
+	default:
+		if currentConfig().Metrics.UnsupportedAsZero {
+			writeMetric(w, name, labelValues, "0")
+			return
+		}
+		// other labels (link, pool, engine...) would multiply the series
+		labelValues2 := map[string]string{"field": name}
+		if gpuId, ok := labelValues["gpu_id"]; ok {
+			labelValues2["gpu_id"] = gpuId
+		}
+		if filter, ok := w.(*filterWriter); ok {
+			key := labelValues2["gpu_id"] + " " + name
+			if filter.unsupportedWritten[key] {
+				return
+			}
+			filter.unsupportedWritten[key] = true
+		}
+		writeMetric(w, "field_unsupported", labelValues2, "1")
+	}
+}
+
+var computeModes = []string{"Default", "Exclusive_Thread", "Prohibited", "Exclusive_Process"}
+
+// configuration of the GPU, to find nodes that drifted from the rest of the fleet
+func writeDeviceStateMetrics(w http.ResponseWriter, labelValues map[string]string, GPU NvidiaSmiGpu) {
+	writeValue(w, "persistence_mode_enabled", labelValues, parseEnabled(GPU.PersistenceMode))
+	writeValue(w, "display_mode_enabled", labelValues, parseEnabled(GPU.DisplayMode))
+	writeValue(w, "display_active", labelValues, parseEnabled(GPU.DisplayActive))
+	writeValue(w, "accounting_mode_enabled", labelValues, parseEnabled(GPU.AccountingMode))
+	writeValue(w, "accounting_mode_buffer_size", labelValues, parseNumber(GPU.AccountingModeBufferSize))
+	writeValue(w, "multigpu_board", labelValues, parseEnabled(GPU.MultiGPUBoard))
+	writeValue(w, "minor_number", labelValues, parseNumber(GPU.MinorNumber))
+
+	// stateset: 1 for the current mode, 0 for others
+	if fieldState(GPU.ComputeMode) == ValueOk {
+		modes := computeModes
+		known := false
+		for _, mode := range modes {
+			known = known || mode == GPU.ComputeMode
+		}
+		if !known {
+			modes = append(modes, GPU.ComputeMode)
+		}
+		for _, mode := range modes {
+			labelValues["mode"] = mode
+			if mode == GPU.ComputeMode {
+				writeMetric(w, "compute_mode", labelValues, "1")
+			} else {
+				writeMetric(w, "compute_mode", labelValues, "0")
+			}
+		}
+		delete(labelValues, "mode")
+	}
+
+	// Windows only
+	if fieldState(GPU.DriverModel.CurrentDM) == ValueOk {
+		labelValues["current"] = GPU.DriverModel.CurrentDM
+		labelValues["pending"] = GPU.DriverModel.PendingDM
+		writeMetric(w, "driver_model_info", labelValues, "1.0")
+	}
+	// Tesla/Quadro only
+	if fieldState(GPU.GPUOperationMode.Current) == ValueOk {
+		labelValues["current"] = GPU.GPUOperationMode.Current
+		labelValues["pending"] = GPU.GPUOperationMode.Pending
+		writeMetric(w, "gpu_operation_mode_info", labelValues, "1.0")
+	}
+	delete(labelValues, "current")
+	delete(labelValues, "pending")
+	if fieldState(GPU.GPUVirtualizationMode.VirtualizationMode) == ValueOk {
+		labelValues["mode"] = GPU.GPUVirtualizationMode.VirtualizationMode
+		labelValues["host_vgpu_mode"] = GPU.GPUVirtualizationMode.HostVGPUMode
+		writeMetric(w, "virtualization_mode_info", labelValues, "1.0")
+		delete(labelValues, "mode")
+		delete(labelValues, "host_vgpu_mode")
+	}
+
+	labelValues2 := map[string]string{
+		"gpu_id":              labelValues["gpu_id"],
+		"vbios_version":       GPU.VbiosVersion,
+		"inforom_img_version": GPU.InfoRomVersion.ImgVersion,
+		"inforom_oem_object":  GPU.InfoRomVersion.OemObject,
+		"inforom_ecc_object":  GPU.InfoRomVersion.EccObject,
+		"inforom_pwr_object":  GPU.InfoRomVersion.PwrObject,
+		"board_id":            GPU.BoardId,
+		"board_part_number":   GPU.BoardPartNumber,
+		"gpu_part_number":     GPU.GPUPartNumber,
+		"bridge_chip_type":    GPU.PCI.BridgeChip.Type,
+		"bridge_chip_fw":      GPU.PCI.BridgeChip.Fw,
+	}
+	writeMetric(w, "device_info", labelValues2, "1.0")
+}
+
+// from least to most severe
+var gpuActions = []string{"none", "reset", "drain_and_reset", "replace"}
+
+// Most severe maintenance action the GPU asks for. Pending page retirements and row remaps
+// take effect on the next reset, a row remapping failure means the GPU should be replaced.
+// ok is false if the GPU reports none of the underlying fields.
+func gpuActionRequired(GPU NvidiaSmiGpu) (action string, ok bool) {
+	resetRequired := parseEnabled(GPU.GPUResetStatus.ResetRequired)
+	drainAndReset := parseEnabled(GPU.GPUResetStatus.DrainAndResetRecommended)
+	retirementPending := parseEnabled(GPU.RetiredPages.PendingRetirement)
+	remapPending := parseEnabled(GPU.RemappedRows.Pending)
+	remapFailure := parseEnabled(GPU.RemappedRows.Failure)
+
+	for _, v := range []Value{resetRequired, drainAndReset, retirementPending, remapPending, remapFailure} {
+		ok = ok || v.State == ValueOk
+	}
+	isSet := func(v Value) bool {
+		return v.State == ValueOk && v.Value == 1
+	}
+	switch {
+	case isSet(remapFailure):
+		action = "replace"
+	case isSet(drainAndReset):
+		action = "drain_and_reset"
+	case isSet(resetRequired) || isSet(retirementPending) || isSet(remapPending):
+		action = "reset"
+	default:
+		action = "none"
+	}
+	return action, ok
+}
+
+func writeResetMetrics(w http.ResponseWriter, labelValues map[string]string, GPU NvidiaSmiGpu) {
+	writeValue(w, "reset_required", labelValues, parseEnabled(GPU.GPUResetStatus.ResetRequired))
+	writeValue(w, "drain_and_reset_recommended", labelValues, parseEnabled(GPU.GPUResetStatus.DrainAndResetRecommended))
+
+	labelValues["cause"] = "single_bit_ecc"
+	writeValue(w, "retired_pages_count", labelValues, parseNumber(GPU.RetiredPages.MultipleSingleBitRetirement.RetiredCount))
+	labelValues["cause"] = "double_bit_ecc"
+	writeValue(w, "retired_pages_count", labelValues, parseNumber(GPU.RetiredPages.DoubleBitRetirement.RetiredCount))
+	labelValues["cause"] = "correctable"
+	writeValue(w, "remapped_rows_count", labelValues, parseNumber(GPU.RemappedRows.Correctable))
+	labelValues["cause"] = "uncorrectable"
+	writeValue(w, "remapped_rows_count", labelValues, parseNumber(GPU.RemappedRows.Uncorrectable))
+	delete(labelValues, "cause")
+	writeValue(w, "retired_pages_pending", labelValues, parseEnabled(GPU.RetiredPages.PendingRetirement))
+	writeValue(w, "remapped_rows_pending", labelValues, parseEnabled(GPU.RemappedRows.Pending))
+	writeValue(w, "remapped_rows_failure", labelValues, parseEnabled(GPU.RemappedRows.Failure))
+
+	// stateset: 1 for the required action, 0 for others
+	if action, ok := gpuActionRequired(GPU); ok {
+		for _, a := range gpuActions {
+			labelValues["action"] = a
+			if a == action {
+				writeMetric(w, "action_required", labelValues, "1")
+			} else {
+				writeMetric(w, "action_required", labelValues, "0")
+			}
+		}
+		delete(labelValues, "action")
+	}
+}
+
+func writeAerMetrics(w http.ResponseWriter, prefix string, labelValues map[string]string, aer AerInfo) {
+	for _, t := range aerTypes {
+		counters, ok := aer[t.name]
+		if !ok {
+			continue
+		}
+		labelValues["aer_type"] = t.name
+		writeMetric(w, prefix+"aer_counter", labelValues, strconv.Itoa(counters.Total))
+
+		errorTypes := make([]string, 0, len(counters.Errors))
+		for k := range counters.Errors {
+			errorTypes = append(errorTypes, k)
+		}
+		sort.Strings(errorTypes)
+		for _, k := range errorTypes {
+			labelValues["error_type"] = k
+			writeMetric(w, prefix+"aer_error_counter", labelValues, strconv.Itoa(counters.Errors[k]))
+		}
+		delete(labelValues, "error_type")
+	}
+	delete(labelValues, "aer_type")
+}
+
+func writeLinkMetrics(w http.ResponseWriter, data *OutputData, labelValues map[string]string, gpuId string, gpuUtil Value) {
+	path := append([]string{gpuId}, data.pciBridges[gpuId]...)
+	for _, id := range path {
+		link, ok := data.linkInfo[id]
+		if !ok {
+			continue
+		}
+		labelValues["pci_id"] = shortPciId(id)
+		writeMetric(w, "pcie_link_speed_current_gts", labelValues, fmt.Sprintf("%g", link.CurrentSpeed))
+		writeMetric(w, "pcie_link_speed_max_gts", labelValues, fmt.Sprintf("%g", link.MaxSpeed))
+		writeMetric(w, "pcie_link_width_current", labelValues, strconv.Itoa(link.CurrentWidth))
+		writeMetric(w, "pcie_link_width_max", labelValues, strconv.Itoa(link.MaxWidth))
+	}
+
+	// links below max speed at idle are normal (power saving), so only report under load
+	underLoad := gpuUtil.State == ValueOk && gpuUtil.Value >= currentConfig().Metrics.PcieLoadThreshold
+	for _, link := range pciLinks(path, data.linkInfo) {
+		labelValues["pci_id"] = shortPciId(link[0])
+		labelValues["upstream_id"] = shortPciId(link[1])
+		degraded := "0"
+		if underLoad && pciLinkDegraded(data.linkInfo[link[0]], data.linkInfo[link[1]]) {
+			degraded = "1"
+		}
+		writeMetric(w, "pcie_link_degraded", labelValues, degraded)
+	}
+	delete(labelValues, "pci_id")
+	delete(labelValues, "upstream_id")
+}
+
+func writeTopologyMetrics(w http.ResponseWriter, data *OutputData, labelValues map[string]string, gpuId string) {
+	topo, ok := data.pciTopology[gpuId]
+	if ok && topo.NumaNode >= 0 {
+		writeMetric(w, "numa_node", labelValues, strconv.Itoa(topo.NumaNode))
+	}
+	if ok && (topo.LocalCpuList != "" || topo.IommuGroup != "" || len(topo.Bridges) > 0) {
+		bridges := data.pciBridges[gpuId]
+		path := make([]string, 0, len(bridges))
+		for i := len(bridges) - 1; i >= 0; i-- {
+			path = append(path, shortPciId(bridges[i]))
+		}
+		labelValues2 := map[string]string{
+			"gpu_id":        labelValues["gpu_id"],
+			"numa_node":     strconv.Itoa(topo.NumaNode),
+			"local_cpulist": topo.LocalCpuList,
+			"iommu_group":   topo.IommuGroup,
+			"pci_path":      strings.Join(path, "/"),
+		}
+		writeMetric(w, "topology_info", labelValues2, "1.0")
+
+		// level 1 is the nearest bridge, the highest level is the root port
+		for i, bridge := range bridges {
+			labelValues2 := map[string]string{
+				"gpu_id":    labelValues["gpu_id"],
+				"bridge_id": shortPciId(bridge),
+				"level":     strconv.Itoa(i + 1),
+			}
+			if i < len(topo.Bridges) {
+				labelValues2["vendor"] = topo.Bridges[i].Vendor
+				labelValues2["device"] = topo.Bridges[i].Device
+			}
+			writeMetric(w, "pci_bridge_info", labelValues2, "1.0")
+		}
+	}
+
+	for _, link := range data.topology[gpuId] {
+		peerId := link.PeerId
+		if link.PeerType == "gpu" {
+			peerId = shortPciId(peerId)
+		}
+		labelValues2 := map[string]string{
+			"gpu_id":    labelValues["gpu_id"],
+			"peer_id":   peerId,
+			"peer_type": link.PeerType,
+			"link_type": link.LinkType,
+		}
+		writeMetric(w, "topology_link_info", labelValues2, "1.0")
+	}
+}
+
+func writeNvLinkMetrics(w http.ResponseWriter, data *OutputData, labelValues map[string]string, uuid string) {
+	links := data.nvLinkInfo[uuid]
+	numbers := make([]int, 0, len(links))
+	for n := range links {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	for _, n := range numbers {
+		link := links[n]
+		labelValues["link"] = strconv.Itoa(n)
+		if link.Active {
+			writeMetric(w, "nvlink_state", labelValues, "1")
+			writeValue(w, "nvlink_speed_bytes_per_second", labelValues, parseUnit(link.Speed))
+		} else {
+			writeMetric(w, "nvlink_state", labelValues, "0")
+		}
+		writeValue(w, "nvlink_data_tx_bytes", labelValues, parseUnit(link.DataTx))
+		writeValue(w, "nvlink_data_rx_bytes", labelValues, parseUnit(link.DataRx))
+
+		errorTypes := make([]string, 0, len(link.Errors))
+		for k := range link.Errors {
+			errorTypes = append(errorTypes, k)
+		}
+		sort.Strings(errorTypes)
+		for _, k := range errorTypes {
+			labelValues["error_type"] = k
+			writeValue(w, "nvlink_error_counter", labelValues, parseNumber(link.Errors[k]))
+		}
+		delete(labelValues, "error_type")
+	}
+	delete(labelValues, "link")
+}
+
+func writeVgpuMetrics(w http.ResponseWriter, data *OutputData, labelValues map[string]string, gpuId string) {
+	host, ok := data.vgpuInfo[gpuId]
+	if !ok {
+		return
+	}
+	writeValue(w, "vgpu_active_count", labelValues, parseNumber(host.ActiveVgpus))
+
+	for _, vgpu := range host.Vgpus {
+		f := vgpu.Fields
+		labelValues["vgpu_id"] = vgpu.Id
+
+		labelValues2 := map[string]string{
+			"gpu_id":               labelValues["gpu_id"],
+			"vgpu_id":              vgpu.Id,
+			"vgpu_uuid":            f["vGPU UUID"],
+			"vgpu_name":            f["vGPU Name"],
+			"vgpu_type":            f["vGPU Type"],
+			"vm_uuid":              f["VM UUID"],
+			"vm_name":              f["VM Name"],
+			"guest_driver_version": f["Guest Driver Version"],
+		}
+		writeMetric(w, "vgpu_info", labelValues2, "1.0")
+
+		// "Licensed (Expiry: 2024-12-31 23:59:59 GMT)", "Unlicensed (Restricted)"
+		if license := f["License Status"]; fieldState(license) == ValueOk {
+			licensed := "0"
+			if strings.HasPrefix(license, "Licensed") {
+				licensed = "1"
+			}
+			writeMetric(w, "vgpu_licensed", labelValues, licensed)
+		}
+
+		writeValue(w, "vgpu_fb_memory_usage_total_bytes", labelValues, parseUnit(f["FB Memory Usage/Total"]))
+		writeValue(w, "vgpu_fb_memory_usage_used_bytes", labelValues, parseUnit(f["FB Memory Usage/Used"]))
+		writeValue(w, "vgpu_fb_memory_usage_free_bytes", labelValues, parseUnit(f["FB Memory Usage/Free"]))
+		for _, e := range [][2]string{
+			{"gpu", "Gpu"},
+			{"memory", "Memory"},
+			{"encoder", "Encoder"},
+			{"decoder", "Decoder"},
+		} {
+			labelValues["engine"] = e[0]
+			writeValue(w, "vgpu_engine_utilization_percent", labelValues, parseUnit(f["Utilization/"+e[1]]))
+		}
+		delete(labelValues, "engine")
+		writeValue(w, "vgpu_encoder_session_count", labelValues, parseNumber(f["Encoder Stats/Active Sessions"]))
+		writeValue(w, "vgpu_encoder_average_fps", labelValues, parseNumber(f["Encoder Stats/Average FPS"]))
+		writeValue(w, "vgpu_encoder_average_latency", labelValues, parseNumber(f["Encoder Stats/Average Latency"]))
+		writeValue(w, "vgpu_fbc_session_count", labelValues, parseNumber(f["FBC Stats/Active Sessions"]))
+		writeValue(w, "vgpu_fbc_average_fps", labelValues, parseNumber(f["FBC Stats/Average FPS"]))
+		writeValue(w, "vgpu_fbc_average_latency", labelValues, parseNumber(f["FBC Stats/Average Latency"]))
+		writeValue(w, "vgpu_frame_rate_limit", labelValues, parseUnit(f["Frame Rate Limit"]))
+	}
+	delete(labelValues, "vgpu_id")
 }
 
 func index(w http.ResponseWriter, r *http.Request) {
-	html := `<!doctype html>
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	var actions string
+	for _, GPU := range currentOutput().nvidiaSmiOutput.GPU {
+		if action, ok := gpuActionRequired(GPU); ok && action != "none" {
+			actions += "\n            <li>" + html.EscapeString(shortPciId(GPU.Id)+" "+GPU.ProductName+": "+action) + "</li>"
+		}
+	}
+	if actions != "" {
+		actions = `
+        <h2>Action required</h2>
+        <ul>` + actions + `
+        </ul>`
+	}
+
+	io.WriteString(w, `<!doctype html>
 <html>
     <head>
         <meta charset="utf-8">
@@ -274,24 +1122,75 @@ func index(w http.ResponseWriter, r *http.Request) {
     </head>
     <body>
         <h1>Nvidia SMI Exporter</h1>
-        <p><a href="/metrics">Metrics</a></p>
+        <p><a href="/metrics">Metrics</a></p>`+actions+`
     </body>
-</html>`
-	io.WriteString(w, html)
+</html>`)
+}
+
+func healthy(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "Healthy\n")
+}
+
+// ready when data has been collected and is not older than the max age
+func ready(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	maxAge := cfg.ReadyMaxAge
+	if maxAge == 0 && cfg.CollectionMode == "interval" {
+		maxAge = 3 * cfg.UpdateInterval
+	}
+	updated := currentOutput().updated
+
+	switch age := time.Since(updated); {
+	case updated.IsZero():
+		http.Error(w, "No data collected yet", http.StatusServiceUnavailable)
+	case maxAge > 0 && age > maxAge:
+		http.Error(w, fmt.Sprintf("Data is %v old, max age is %v", age.Round(time.Millisecond), maxAge), http.StatusServiceUnavailable)
+	default:
+		io.WriteString(w, "Ready\n")
+	}
+}
+
+func reload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := reloadConfig(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to reload config: %v", err), http.StatusInternalServerError)
+	}
 }
 
 func main() {
 	kingpin.Version(version.Print("nvidiasmi_exporter"))
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	command := kingpin.Parse()
+
+	cfg, err := loadConfig(*configFile)
+	switch command {
+	case checkConfigCommand.FullCommand():
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("Config is valid")
+		return
+	case serveCommand.FullCommand():
+		if err != nil {
+			log.Fatalln(err)
+		}
+		setConfig(cfg)
+	}
 
 	log.Infoln("Starting Nvidia SMI exporter")
 
 	if *testFile != "" {
 		log.Infoln("Test mode is enabled")
 	}
+	if *eventBufferSize < 1 {
+		log.Fatalln("--events.buffer-size must be at least 1")
+	}
 
-	err := readData()
+	err = updateData(context.Background(), 0, nil)
 	if err != nil {
 		// initial update must succeed, otherwise exit
 		log.Fatalln(err)
@@ -299,16 +1198,48 @@ func main() {
 
 	go func() {
 		for {
-			time.Sleep(*updateInterval)
-			err := readData()
+			time.Sleep(currentConfig().UpdateInterval)
+			// keeps running in scrape mode, the mode can be changed by reloading the config
+			if currentConfig().CollectionMode != "interval" {
+				continue
+			}
+			err := updateData(context.Background(), 0, nil)
 			if err != nil {
 				log.Errorln(err)
 			}
 		}
 	}()
 
+	// the listener is kept on reload, --listen can only be changed by restart
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadConfig()
+		}
+	}()
+
+	listener, err := listen(*listenAddress, currentConfig().Web)
+	if err != nil {
+		log.Fatalln(err)
+	}
 	log.Infoln("Nvidia SMI exporter listening on", *listenAddress)
-	http.HandleFunc("/", index)
-	http.HandleFunc("/metrics", metrics)
-	http.ListenAndServe(*listenAddress, nil)
+	// not http.DefaultServeMux, net/http/pprof registers itself there
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", index)
+	mux.HandleFunc("/metrics", metrics)
+	mux.HandleFunc("/-/reload", reload)
+	mux.HandleFunc("/-/healthy", healthy)
+	mux.HandleFunc("/-/ready", ready)
+	mux.HandleFunc("/debug/state", debugState)
+	mux.HandleFunc("/api/v1/", api)
+	mux.HandleFunc("/api/v1/events", eventStream)
+	if *enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	http.Serve(listener, authenticate(mux))
 }
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// Data sources besides nvidia-smi -q -x. Each collector runs in its own goroutine with
+// a timeout, so that a failing or hanging source cannot break or hold up the others.
+// If a collector fails, the data of its last successful run is kept, unless it is volatile.
+type Collector interface {
+	// Read data for the GPUs of core (only nvidiaSmiOutput and pciBridges are set, read-only)
+	// and return a function storing it into the snapshot. Never called concurrently for
+	// the same collector, so collectors may cache data between runs.
+	Update(ctx context.Context, core *OutputData) (store func(*OutputData), err error)
+}
+
+// Implemented by collectors whose data only holds while it is fresh (e.g. running processes),
+// their data is dropped when they fail instead of kept.
+type volatileCollector interface {
+	volatile()
+}
+
+type CollectorStatus struct {
+	Success     bool
+	Duration    time.Duration
+	Error       string
+	LastRun     time.Time
+	LastSuccess time.Time
+}
+
+const (
+	defaultCollectorTimeout = 10 * time.Second
+	collectorGracePeriod    = 500 * time.Millisecond
+)
+
+type collectorEntry struct {
+	name      string
+	collector Collector
+	metrics   *regexp.Regexp // names of the metrics based on its data, for collect[] params
+	enabled   *bool
+	interval  *time.Duration
+
+	// state, only accessed from readData
+	lastRun time.Time
+	done    chan struct{} // closed when the last run has finished
+	store   func(*OutputData)
+}
+
+var collectors = make(map[string]*collectorEntry)
+
+func (entry *collectorEntry) dropVolatileData() {
+	if _, ok := entry.collector.(volatileCollector); ok {
+		entry.store = nil
+	}
+}
+
+// flags of older versions, enabling a collector that is disabled by default
+var legacyCollectorFlags = map[string]*bool{
+	"nvlink":       nvLink,
+	"nvswitch":     nvSwitch,
+	"conf_compute": confCompute,
+}
+
+// called from init(), defines --[no-]collector.<name> and --collector.<name>.interval flags.
+// metrics is a regex matching the names (without nvidiasmi_ prefix) of the metrics
+// exposed from the data of the collector, empty if it only adds to other metrics.
+func registerCollector(name string, defaultEnabled bool, help string, metrics string, collector Collector) {
+	state := "disabled"
+	if defaultEnabled {
+		state = "enabled"
+	}
+	var metricsRe *regexp.Regexp
+	if metrics != "" {
+		metricsRe = regexp.MustCompile("^(?:" + metrics + ")$")
+	}
+	collectors[name] = &collectorEntry{
+		name:      name,
+		collector: collector,
+		metrics:   metricsRe,
+		enabled: kingpin.Flag(
+			"collector."+name,
+			fmt.Sprintf("Enable the %s collector: %s (default: %s)", name, help, state),
+		).Default(fmt.Sprintf("%v", defaultEnabled)).Bool(),
+		interval: kingpin.Flag(
+			"collector."+name+".interval",
+			fmt.Sprintf("How often to run the %s collector (default: every update)", name),
+		).Default("0s").Duration(),
+	}
+}
+
+func collectorNames() []string {
+	names := make([]string, 0, len(collectors))
+	for name := range collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Runs the enabled collectors that are due and stores their data (or the data of
+// their last successful run) into data. Returns status of all enabled collectors.
+// Collectors still running at the deadline of ctx are reported as failed. If selected
+// is not nil, only the collectors in it are run (collect[] params of a scrape).
+func runCollectors(ctx context.Context, cfg *Config, data *OutputData, prevStatus map[string]CollectorStatus, selected map[string]bool) map[string]CollectorStatus {
+	type result struct {
+		entry    *collectorEntry
+		store    func(*OutputData)
+		err      error
+		duration time.Duration
+	}
+	results := make(chan result, len(collectors))
+	status := make(map[string]CollectorStatus)
+	started := make(map[string]time.Time) // deadline by name
+
+	now := time.Now()
+	for _, name := range collectorNames() {
+		entry := collectors[name]
+		settings := cfg.collector(name)
+		if !settings.Enabled {
+			entry.store = nil
+			continue
+		}
+		status[name] = prevStatus[name]
+
+		running := false
+		if entry.done != nil {
+			select {
+			case <-entry.done:
+			default:
+				running = true
+			}
+		}
+		if running || now.Sub(entry.lastRun) < settings.Interval || selected != nil && !selected[name] {
+			continue
+		}
+
+		entry.lastRun = now
+		entry.done = make(chan struct{})
+		deadline := now.Add(settings.Timeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		// a little later, for collectors to return after the context is done
+		started[name] = deadline.Add(collectorGracePeriod)
+		go func(entry *collectorEntry, deadline time.Time) {
+			defer close(entry.done)
+			ctx, cancel := context.WithDeadline(ctx, deadline)
+			defer cancel()
+			start := time.Now()
+			r := result{entry: entry}
+			func() {
+				defer func() {
+					if p := recover(); p != nil {
+						r.err = fmt.Errorf("panic: %v", p)
+					}
+				}()
+				r.store, r.err = entry.collector.Update(ctx, data)
+			}()
+			if r.err == nil && ctx.Err() != nil {
+				r.err = ctx.Err()
+			}
+			r.duration = time.Since(start)
+			results <- r
+		}(entry, deadline)
+	}
+
+	// collectors that do not return in time are reported as failed, their result is dropped
+	done := ctx.Done()
+	for len(started) > 0 {
+		var next time.Time
+		for _, deadline := range started {
+			if next.IsZero() || deadline.Before(next) {
+				next = deadline
+			}
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case r := <-results:
+			timer.Stop()
+			if _, ok := started[r.entry.name]; !ok {
+				continue
+			}
+			delete(started, r.entry.name)
+			s := status[r.entry.name]
+			s.LastRun = now
+			s.Duration = r.duration
+			s.Success = r.err == nil
+			s.Error = ""
+			if r.err != nil {
+				s.Error = r.err.Error()
+				log.Errorf("Collector %s failed: %v", r.entry.name, r.err)
+				r.entry.dropVolatileData()
+			} else {
+				s.LastSuccess = now
+				r.entry.store = r.store
+			}
+			status[r.entry.name] = s
+		case <-done:
+			// collection aborted (the deadline of ctx may have been moved), collectors get the grace period to return
+			timer.Stop()
+			done = nil
+			for name, deadline := range started {
+				if limit := time.Now().Add(collectorGracePeriod); limit.Before(deadline) {
+					started[name] = limit
+				}
+			}
+		case <-timer.C:
+			for name, deadline := range started {
+				if time.Now().Before(deadline) {
+					continue
+				}
+				delete(started, name)
+				s := status[name]
+				s.LastRun = now
+				s.Success = false
+				s.Duration = time.Since(now)
+				s.Error = fmt.Sprintf("no result after %v", s.Duration.Round(time.Millisecond))
+				status[name] = s
+				log.Errorf("Collector %s failed: %s", name, s.Error)
+				collectors[name].dropVolatileData()
+			}
+		}
+	}
+
+	for _, name := range collectorNames() {
+		if entry := collectors[name]; entry.store != nil {
+			entry.store(data)
+		}
+	}
+	return status
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type countingCollector struct {
+	runs int
+	fail bool
+}
+
+func (c *countingCollector) Update(ctx context.Context, core *OutputData) (func(*OutputData), error) {
+	c.runs++
+	runs := c.runs
+	if c.fail {
+		return nil, errors.New("failed")
+	}
+	return func(data *OutputData) {
+		data.fabricManager = string(rune('0' + runs))
+	}, nil
+}
+
+// config with only the given collectors enabled
+func testCollectorConfig(names ...string) Config {
+	disabled := false
+	cfg := *currentConfig()
+	cfg.Collectors = make(map[string]CollectorSettings)
+	for _, name := range collectorNames() {
+		cfg.Collectors[name] = CollectorSettings{Enabled: &disabled}
+	}
+	for _, name := range names {
+		delete(cfg.Collectors, name)
+	}
+	return cfg
+}
+
+// collectors not selected by collect[] are not run, the data of their last run is kept
+func TestRunCollectorsSelected(t *testing.T) {
+	enabled := true
+	var interval time.Duration
+	c := &countingCollector{}
+	collectors["test"] = &collectorEntry{name: "test", collector: c, enabled: &enabled, interval: &interval}
+	defer delete(collectors, "test")
+
+	// only the test collector, and aer as the other selectable one
+	cfg := testCollectorConfig("test", "aer")
+
+	var data OutputData
+	status := runCollectors(context.Background(), &cfg, &data, nil, nil)
+	if c.runs != 1 || data.fabricManager != "1" || !status["test"].Success {
+		t.Fatalf("first run: %d runs, data %q, status %+v", c.runs, data.fabricManager, status["test"])
+	}
+
+	data = OutputData{}
+	status = runCollectors(context.Background(), &cfg, &data, status, map[string]bool{"aer": true})
+	if c.runs != 1 || data.fabricManager != "1" || !status["test"].Success {
+		t.Errorf("not selected: %d runs, data %q, status %+v", c.runs, data.fabricManager, status["test"])
+	}
+
+	data = OutputData{}
+	runCollectors(context.Background(), &cfg, &data, status, map[string]bool{"test": true})
+	if c.runs != 2 || data.fabricManager != "2" {
+		t.Errorf("selected: %d runs, data %q", c.runs, data.fabricManager)
+	}
+}
+
+type volatileCountingCollector struct {
+	countingCollector
+}
+
+func (c *volatileCountingCollector) volatile() {}
+
+// data of a failed run is kept, unless the collector is volatile
+func TestRunCollectorsFailed(t *testing.T) {
+	enabled := true
+	var interval time.Duration
+	c := &countingCollector{}
+	v := &volatileCountingCollector{}
+	collectors["test"] = &collectorEntry{name: "test", collector: c, enabled: &enabled, interval: &interval}
+	collectors["volatile"] = &collectorEntry{name: "volatile", collector: v, enabled: &enabled, interval: &interval}
+	defer delete(collectors, "test")
+	defer delete(collectors, "volatile")
+	cfg := testCollectorConfig("test")
+	cfgVolatile := testCollectorConfig("volatile")
+
+	for _, tt := range []struct {
+		name string
+		cfg  *Config
+		c    *countingCollector
+		want string
+	}{
+		{"kept", &cfg, c, "1"},
+		{"volatile", &cfgVolatile, &v.countingCollector, ""},
+	} {
+		var data OutputData
+		status := runCollectors(context.Background(), tt.cfg, &data, nil, nil)
+		tt.c.fail = true
+		data = OutputData{}
+		status = runCollectors(context.Background(), tt.cfg, &data, status, nil)
+		if tt.c.runs != 2 || status[tt.name].Success || data.fabricManager != tt.want {
+			t.Errorf("%s: %d runs, data %q, status %+v", tt.name, tt.c.runs, data.fabricManager, status[tt.name])
+		}
+	}
+}
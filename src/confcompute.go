@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Confidential computing state (Hopper and later), system-wide
+type ConfComputeInfo struct {
+	Status     string // "ON" / "OFF"
+	ReadyState string // "ready" / "not-ready"
+}
+
+// Parse "Key: Value" lines of `nvidia-smi conf-compute` output:
+//
+//	CC status: ON
+//	Confidential Compute GPU Ready State: ready
+func parseConfComputeOutput(data []byte) map[string]string {
+	result := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, ":"); i > 0 {
+			result[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	return result
+}
+
+func readConfComputeInfo(ctx context.Context) (ConfComputeInfo, error) {
+	var result ConfComputeInfo
+
+	stdout, err := runNvidiaSmi(ctx, *testCcStatusFile, "conf-compute", "-f")
+	if err != nil {
+		return result, fmt.Errorf("nvidia-smi conf-compute -f: %v", err)
+	}
+	result.Status = parseConfComputeOutput(stdout)["CC status"]
+
+	stdout, err = runNvidiaSmi(ctx, *testCcReadyStateFile, "conf-compute", "-grs")
+	if err != nil {
+		return result, fmt.Errorf("nvidia-smi conf-compute -grs: %v", err)
+	}
+	result.ReadyState = parseConfComputeOutput(stdout)["Confidential Compute GPU Ready State"]
+
+	return result, nil
+}
+
+func init() {
+	registerCollector("conf_compute", false, "confidential computing mode and GPU ready state from `nvidia-smi conf-compute`", "cc_.*", &confComputeCollector{})
+}
+
+type confComputeCollector struct{}
+
+func (c *confComputeCollector) Update(ctx context.Context, core *OutputData) (func(*OutputData), error) {
+	info, err := readConfComputeInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return func(data *OutputData) {
+		data.confCompute = info
+	}, nil
+}
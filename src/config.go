@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+Settings that can be changed in the config file and reloaded on SIGHUP or POST /-/reload.
+Command line flags provide the defaults, keys present in the file override them:
+
+sources:
+  nvidia_smi_path: /usr/bin/nvidia-smi
+  gddr6_path: /usr/local/bin/gddr6
+  pci_ids_path: /usr/share/misc/pci.ids
+update_interval: 5s
+collection_mode: interval   # or scrape
+min_refresh_interval: 1s
+ready_max_age: 15s          # default 3 update intervals in interval mode
+collectors:
+  nvlink: true          # same as --collector.nvlink
+  topology: false
+  process:
+    interval: 30s
+    timeout: 5s
+metrics:
+  unsupported_as_zero: false
+  supported_clocks: false
+  pcie_load_threshold: 10
+  filters:
+    exclude_metrics: ['nvidiasmi_process_.*']
+    exclude_labels: {gpu_name: '.*T400.*'}
+  relabel_configs:
+    - source_labels: [__name__]
+      regex: 'nvidiasmi_aer_.*'
+      action: drop
+labels:
+  gpu: [gpu_uuid, gpu_index]   # default [gpu_id]
+  static: {cluster: a, rack: r12}
+  hostname: true
+events:
+  temperature_threshold: 85
+# firmware_policy_file: /etc/nvidiasmi_exporter/firmware.json, or inline:
+firmware_policy:
+  rules:
+    - product: NVIDIA GeForce RTX 4090
+      versions: {driver: 550.90.07}
+*/
+
+type Config struct {
+	Sources            SourcesConfig                `yaml:"sources"`
+	UpdateInterval     time.Duration                `yaml:"update_interval"`
+	CollectionMode     string                       `yaml:"collection_mode"`
+	MinRefreshInterval time.Duration                `yaml:"min_refresh_interval"`
+	ReadyMaxAge        time.Duration                `yaml:"ready_max_age"`
+	Collectors         map[string]CollectorSettings `yaml:"collectors"` // by name, overriding flags
+	Metrics            MetricsConfig                `yaml:"metrics"`
+	Labels             LabelsConfig                 `yaml:"labels"`
+	Events             EventsConfig                 `yaml:"events"`
+	FirmwarePolicyFile string                       `yaml:"firmware_policy_file"`
+	FirmwarePolicy     *FirmwarePolicy              `yaml:"firmware_policy"`
+	Web                *WebConfig                   `yaml:"-"` // from --web.config.file
+}
+
+type SourcesConfig struct {
+	NvidiaSmiPath string `yaml:"nvidia_smi_path"`
+	Gddr6Path     string `yaml:"gddr6_path"`
+	PciIdsPath    string `yaml:"pci_ids_path"`
+}
+
+// "name: true" or "name: {enabled: true, interval: 1m, timeout: 5s}", unset fields keep flag values
+type CollectorSettings struct {
+	Enabled  *bool          `yaml:"enabled"`
+	Interval *time.Duration `yaml:"interval"`
+	Timeout  *time.Duration `yaml:"timeout"`
+}
+
+func (s *CollectorSettings) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&s.Enabled)
+	}
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i < len(node.Content); i += 2 {
+			switch key := node.Content[i]; key.Value {
+			case "enabled", "interval", "timeout":
+			default:
+				return fmt.Errorf("line %d: unknown collector setting %q", key.Line, key.Value)
+			}
+		}
+	}
+	type plain CollectorSettings
+	return node.Decode((*plain)(s))
+}
+
+// effective settings of a collector
+type CollectorConfig struct {
+	Enabled  bool
+	Interval time.Duration // 0: every update
+	Timeout  time.Duration
+}
+
+type EventsConfig struct {
+	TemperatureThreshold float64 `yaml:"temperature_threshold"`
+}
+
+type MetricsConfig struct {
+	UnsupportedAsZero bool            `yaml:"unsupported_as_zero"`
+	SupportedClocks   bool            `yaml:"supported_clocks"`
+	PcieLoadThreshold float64         `yaml:"pcie_load_threshold"`
+	Filters           FilterConfig    `yaml:"filters"`
+	RelabelConfigs    []RelabelConfig `yaml:"relabel_configs"`
+}
+
+var (
+	configMutex sync.RWMutex
+	config      *Config
+)
+
+func currentConfig() *Config {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config
+}
+
+func setConfig(cfg *Config) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config = cfg
+}
+
+func configFromFlags() *Config {
+	cfg := &Config{}
+	cfg.Sources.NvidiaSmiPath = *nvidiaSmiPath
+	cfg.Sources.Gddr6Path = *gddr6Path
+	cfg.Sources.PciIdsPath = *pciIdsPath
+	cfg.UpdateInterval = *updateInterval
+	cfg.CollectionMode = *collectionMode
+	cfg.MinRefreshInterval = *minRefreshInterval
+	cfg.ReadyMaxAge = *readyMaxAge
+	cfg.Metrics.UnsupportedAsZero = *unsupportedAsZero
+	cfg.Metrics.SupportedClocks = *supportedClocks
+	cfg.Metrics.PcieLoadThreshold = *pcieLoadThreshold
+	cfg.Labels.Gpu = *gpuLabels
+	// copied, the config file is decoded into it
+	cfg.Labels.Static = make(map[string]string)
+	for k, v := range *staticLabels {
+		cfg.Labels.Static[k] = v
+	}
+	cfg.Labels.Hostname = *hostnameLabel
+	cfg.Events.TemperatureThreshold = *eventTemperatureThreshold
+	cfg.FirmwarePolicyFile = *firmwarePolicyFile
+	return cfg
+}
+
+// Errors are prefixed with file name and line number where possible.
+func loadConfig(file string) (*Config, error) {
+	cfg := configFromFlags()
+	root := &yaml.Node{}
+
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		// empty file is a valid config
+		if err := decoder.Decode(cfg); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		if err := yaml.Unmarshal(data, root); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+
+	fail := func(path []string, format string, args ...interface{}) error {
+		msg := fmt.Sprintf(format, args...)
+		if line := configLine(root, path...); line > 0 {
+			return fmt.Errorf("%s:%d: %s", file, line, msg)
+		}
+		if file != "" {
+			return fmt.Errorf("%s: %s", file, msg)
+		}
+		return errors.New(msg)
+	}
+	if cfg.Sources.NvidiaSmiPath == "" {
+		return nil, fail([]string{"sources", "nvidia_smi_path"}, "sources.nvidia_smi_path must not be empty")
+	}
+	if cfg.UpdateInterval <= 0 {
+		return nil, fail([]string{"update_interval"}, "update_interval must be positive")
+	}
+	if cfg.CollectionMode != "interval" && cfg.CollectionMode != "scrape" {
+		return nil, fail([]string{"collection_mode"}, "collection_mode must be interval or scrape, not %q", cfg.CollectionMode)
+	}
+	if cfg.MinRefreshInterval < 0 {
+		return nil, fail([]string{"min_refresh_interval"}, "min_refresh_interval must not be negative")
+	}
+	if cfg.ReadyMaxAge < 0 {
+		return nil, fail([]string{"ready_max_age"}, "ready_max_age must not be negative")
+	}
+	for name, settings := range cfg.Collectors {
+		path := []string{"collectors", name}
+		if _, ok := collectors[name]; !ok {
+			return nil, fail(path, "unknown collector %q", name)
+		}
+		if settings.Interval != nil && *settings.Interval < 0 {
+			return nil, fail(path, "collectors.%s.interval must not be negative", name)
+		}
+		if settings.Timeout != nil && *settings.Timeout <= 0 {
+			return nil, fail(path, "collectors.%s.timeout must be positive", name)
+		}
+	}
+	if cfg.Metrics.PcieLoadThreshold < 0 || cfg.Metrics.PcieLoadThreshold > 100 {
+		return nil, fail([]string{"metrics", "pcie_load_threshold"}, "metrics.pcie_load_threshold must be between 0 and 100")
+	}
+	for _, labels := range []map[string]Regexp{cfg.Metrics.Filters.IncludeLabels, cfg.Metrics.Filters.ExcludeLabels} {
+		for label := range labels {
+			if !labelNameRe.MatchString(label) {
+				return nil, fail([]string{"metrics", "filters"}, "invalid label name %q in metrics.filters", label)
+			}
+		}
+	}
+	if cfg.Events.TemperatureThreshold < 0 {
+		return nil, fail([]string{"events", "temperature_threshold"}, "events.temperature_threshold must not be negative")
+	}
+	if len(cfg.Labels.Gpu) == 0 {
+		return nil, fail([]string{"labels", "gpu"}, "labels.gpu must not be empty")
+	}
+	for _, label := range cfg.Labels.Gpu {
+		known := false
+		for _, name := range gpuIdentityLabelNames {
+			known = known || label == name
+		}
+		if !known {
+			return nil, fail([]string{"labels", "gpu"}, "unknown GPU label %q in labels.gpu, must be one of %s", label, strings.Join(gpuIdentityLabelNames, ", "))
+		}
+	}
+	static := make(map[string]string)
+	for label, value := range cfg.Labels.Static {
+		if !labelNameRe.MatchString(label) || strings.HasPrefix(label, "__") {
+			return nil, fail([]string{"labels", "static"}, "invalid label name %q in labels.static", label)
+		}
+		static[label] = value
+	}
+	if _, ok := static["hostname"]; cfg.Labels.Hostname && !ok {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		static["hostname"] = hostname
+	}
+	cfg.Labels.Static = static
+	for i := range cfg.Metrics.RelabelConfigs {
+		if err := cfg.Metrics.RelabelConfigs[i].validate(); err != nil {
+			return nil, fail([]string{"metrics", "relabel_configs", strconv.Itoa(i)}, "metrics.relabel_configs[%d]: %v", i, err)
+		}
+	}
+
+	if cfg.FirmwarePolicy != nil {
+		if configLine(root, "firmware_policy_file") > 0 {
+			return nil, fail([]string{"firmware_policy"}, "firmware_policy and firmware_policy_file are mutually exclusive")
+		}
+		if err := cfg.FirmwarePolicy.validate(); err != nil {
+			return nil, fail([]string{"firmware_policy", "rules"}, "firmware_policy: %v", err)
+		}
+	} else if cfg.FirmwarePolicyFile != "" {
+		policy, err := loadFirmwarePolicy(cfg.FirmwarePolicyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.FirmwarePolicy = policy
+	}
+
+	web, err := loadWebConfig(*webConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Web = web
+
+	return cfg, nil
+}
+
+func (cfg *Config) collector(name string) CollectorConfig {
+	entry, ok := collectors[name]
+	if !ok {
+		return CollectorConfig{}
+	}
+	result := CollectorConfig{
+		Enabled:  *entry.enabled,
+		Interval: *entry.interval,
+		Timeout:  defaultCollectorTimeout,
+	}
+	if legacy, ok := legacyCollectorFlags[name]; ok && *legacy {
+		result.Enabled = true
+	}
+	settings := cfg.Collectors[name]
+	if settings.Enabled != nil {
+		result.Enabled = *settings.Enabled
+	}
+	if settings.Interval != nil {
+		result.Interval = *settings.Interval
+	}
+	if settings.Timeout != nil {
+		result.Timeout = *settings.Timeout
+	}
+	return result
+}
+
+// line of the value at the given path of mapping keys (or sequence indexes), 0 if not found
+func configLine(node *yaml.Node, path ...string) int {
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for _, key := range path {
+		if node.Kind == yaml.SequenceNode {
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node.Content) {
+				return 0
+			}
+			node = node.Content[i]
+			continue
+		}
+		if node.Kind != yaml.MappingNode {
+			return 0
+		}
+		var next *yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				next = node.Content[i+1]
+			}
+		}
+		if next == nil {
+			return 0
+		}
+		node = next
+	}
+	return node.Line
+}
+
+func reloadConfig() error {
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		log.Errorln("Error reloading config:", err)
+		return err
+	}
+	if (cfg.Web.tlsConfig == nil) != (currentConfig().Web.tlsConfig == nil) {
+		err := errors.New("TLS cannot be enabled or disabled by reloading, restart the exporter")
+		log.Errorln("Error reloading config:", err)
+		return err
+	}
+	setConfig(cfg)
+	log.Infoln("Config reloaded")
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content string
+		err     string // substring of the error, empty: valid
+	}{
+		{"empty", "", ""},
+		{"valid", "update_interval: 10s\ncollection_mode: scrape\ncollectors:\n  nvlink: {enabled: true, interval: 1m}\n", ""},
+		{"unknown key", "update_interval: 10s\nupdate_intervall: 5s\n", "line 2: field update_intervall not found"},
+		{"unknown nested key", "metrics:\n  pcie_load: 10\n", "line 2: field pcie_load not found"},
+		{"bad duration", "update_interval: often\n", "line 1: cannot unmarshal !!str `often` into time.Duration"},
+		{"bad type", "metrics:\n  pcie_load_threshold: [10]\n", "line 2: cannot unmarshal !!seq into float64"},
+		{"bad regex", "metrics:\n  filters:\n    exclude_metrics: ['(']\n", `line 3: invalid regex "("`},
+		{"invalid value", "update_interval: 5s\nmetrics:\n  pcie_load_threshold: 120\n", "config.yml:3: metrics.pcie_load_threshold must be between 0 and 100"},
+		{"invalid mode", "collection_mode: sometimes\n", `config.yml:1: collection_mode must be interval or scrape, not "sometimes"`},
+		{"unknown collector", "collectors:\n  foo: {enabled: true}\n", `config.yml:2: unknown collector "foo"`},
+		{"negative duration", "collectors:\n  aer: {interval: -1s}\n", "config.yml:2: collectors.aer.interval must not be negative"},
+		{"relabel index", "metrics:\n  relabel_configs:\n    - source_labels: [gpu_id]\n      target_label: a\n    - source_labels: [gpu_id]\n      action: delete\n", "config.yml:5:"},
+		{"constant replace", "metrics:\n  relabel_configs:\n    - target_label: env\n      replacement: prod\n", ""},
+		{"keep without source", "metrics:\n  relabel_configs:\n    - regex: x\n      action: keep\n", "source_labels must not be empty for action keep"},
+		{"unknown gpu label", "labels:\n  gpu: [gpu_slot]\n", `config.yml:2: unknown GPU label "gpu_slot"`},
+	}
+	for _, tt := range tests {
+		file := writeTestFile(t, dir, "config.yml", tt.content)
+		cfg, err := loadConfig(file)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		case tt.err != "" && err == nil:
+			t.Errorf("%s: expected error containing %q", tt.name, tt.err)
+		case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+			t.Errorf("%s: error %q does not contain %q", tt.name, err, tt.err)
+		case tt.err == "" && cfg == nil:
+			t.Errorf("%s: no config", tt.name)
+		}
+	}
+
+	// keys override flags, others keep the flag values
+	file := writeTestFile(t, dir, "config.yml", "update_interval: 10s\n")
+	cfg, err := loadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.UpdateInterval != 10*time.Second || cfg.CollectionMode != *collectionMode || !cfg.collector("aer").Enabled {
+		t.Errorf("got update interval %v, mode %s, aer enabled %v", cfg.UpdateInterval, cfg.CollectionMode, cfg.collector("aer").Enabled)
+	}
+
+	// static labels of one file are not kept for the next
+	if _, err := loadConfig(writeTestFile(t, dir, "config.yml", "labels:\n  static: {cluster: a}\n")); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err = loadConfig(writeTestFile(t, dir, "config.yml", "")); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Labels.Static) != 0 || len(*staticLabels) != 0 {
+		t.Errorf("static labels %v, flag %v", cfg.Labels.Static, *staticLabels)
+	}
+}
+
+// self-signed certificate and key for localhost
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := writeTestFile(t, dir, "tls.crt", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	keyFile := writeTestFile(t, dir, "tls.key", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})))
+	return certFile, keyFile
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prevConfig := currentConfig()
+	defer func() {
+		*configFile, *webConfigFile = "", ""
+		setConfig(prevConfig)
+	}()
+
+	*configFile = writeTestFile(t, dir, "config.yml", "update_interval: 10s\n")
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setConfig(cfg)
+
+	// changes are applied
+	writeTestFile(t, dir, "config.yml", "update_interval: 20s\n")
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if currentConfig().UpdateInterval != 20*time.Second {
+		t.Errorf("update interval %v after reload, want 20s", currentConfig().UpdateInterval)
+	}
+
+	// an invalid file keeps the previous config
+	writeTestFile(t, dir, "config.yml", "update_interval: 0s\n")
+	if err := reloadConfig(); err == nil || !strings.Contains(err.Error(), "update_interval must be positive") {
+		t.Errorf("reload of invalid config: error %v", err)
+	}
+	writeTestFile(t, dir, "config.yml", "update_interval: [\n")
+	if err := reloadConfig(); err == nil {
+		t.Error("reload of unparsable config: no error")
+	}
+	if currentConfig().UpdateInterval != 20*time.Second {
+		t.Errorf("update interval %v after failed reloads, want 20s", currentConfig().UpdateInterval)
+	}
+
+	// TLS cannot be enabled by a reload, but authentication can
+	writeTestFile(t, dir, "config.yml", "update_interval: 30s\n")
+	certFile, keyFile := writeTestCertificate(t, dir)
+	*webConfigFile = writeTestFile(t, dir, "web.yml", "tls_server_config:\n  cert_file: "+certFile+"\n  key_file: "+keyFile+"\n")
+	if err := reloadConfig(); err == nil || !strings.Contains(err.Error(), "TLS cannot be enabled or disabled") {
+		t.Errorf("reload enabling TLS: error %v", err)
+	}
+	if currentConfig().UpdateInterval != 20*time.Second || currentConfig().Web.tlsConfig != nil {
+		t.Error("config changed by a reload enabling TLS")
+	}
+	writeTestFile(t, dir, "web.yml", "bearer_tokens: [secret]\n")
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if !currentConfig().Web.checkBearerToken("secret") {
+		t.Error("bearer token not applied by reload")
+	}
+
+	// nor disabled
+	writeTestFile(t, dir, "web.yml", "tls_server_config:\n  cert_file: "+certFile+"\n  key_file: "+keyFile+"\n")
+	cfg, err = loadConfig(*configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setConfig(cfg)
+	writeTestFile(t, dir, "web.yml", "")
+	if err := reloadConfig(); err == nil || !strings.Contains(err.Error(), "TLS cannot be enabled or disabled") {
+		t.Errorf("reload disabling TLS: error %v", err)
+	}
+	if currentConfig().Web.tlsConfig == nil {
+		t.Error("TLS disabled by reload")
+	}
+}
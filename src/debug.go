@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+type sourceState struct {
+	Enabled         bool       `json:"enabled"`
+	Success         bool       `json:"success"`
+	LastRun         *time.Time `json:"last_run,omitempty"`
+	LastSuccess     *time.Time `json:"last_success,omitempty"`
+	DurationSeconds float64    `json:"duration_seconds"`
+	Error           string     `json:"error,omitempty"`
+}
+
+func newSourceState(enabled bool, status CollectorStatus) sourceState {
+	result := sourceState{
+		Enabled:         enabled,
+		Success:         status.Success,
+		DurationSeconds: status.Duration.Seconds(),
+		Error:           status.Error,
+	}
+	if !status.LastRun.IsZero() {
+		result.LastRun = &status.LastRun
+	}
+	if !status.LastSuccess.IsZero() {
+		result.LastSuccess = &status.LastSuccess
+	}
+	return result
+}
+
+// Current snapshot with status of nvidia-smi and all collectors, for debugging
+func debugState(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	storedOutputMutex.RLock()
+	data := storedOutput
+	sources := map[string]sourceState{
+		"nvidia_smi": newSourceState(true, nvidiaSmiStatus),
+	}
+	storedOutputMutex.RUnlock()
+	for _, name := range collectorNames() {
+		sources[name] = newSourceState(cfg.collector(name).Enabled, data.collectorStatus[name])
+	}
+
+	state := struct {
+		CollectionMode string                 `json:"collection_mode"`
+		Updated        *time.Time             `json:"updated,omitempty"`
+		AgeSeconds     float64                `json:"age_seconds,omitempty"`
+		Sources        map[string]sourceState `json:"sources"`
+		Data           map[string]interface{} `json:"data"`
+	}{
+		CollectionMode: cfg.CollectionMode,
+		Sources:        sources,
+		Data: map[string]interface{}{
+			"nvidia_smi":      data.nvidiaSmiOutput,
+			"aer":             data.aerInfo,
+			"pci_bridges":     data.pciBridges,
+			"bridge_aer":      data.bridgeAerInfo,
+			"pcie_link":       data.linkInfo,
+			"pci_topology":    data.pciTopology,
+			"topology":        data.topology,
+			"nvlink":          data.nvLinkInfo,
+			"vgpu":            data.vgpuInfo,
+			"conf_compute":    data.confCompute,
+			"nvswitch":        data.nvSwitchInfo,
+			"fabric_manager":  data.fabricManager,
+			"pci_vendor_info": data.vendorInfo,
+			"process":         data.processInfo,
+			"gddr6":           data.temperatures,
+			"xid":             data.xidErrors,
+		},
+	}
+	if updated := data.updated; !updated.IsZero() {
+		state.Updated = &updated
+		state.AgeSeconds = time.Since(updated).Seconds()
+	}
+
+	writeJSON(w, http.StatusOK, state)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Changes between two snapshots, pushed to clients of /api/v1/events (server-sent events)
+type Event struct {
+	Id      uint64                 `json:"id"`
+	Time    time.Time              `json:"time"`
+	Type    string                 `json:"type"`
+	GpuUUID string                 `json:"gpu_uuid,omitempty"`
+	GpuId   string                 `json:"gpu_id,omitempty"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+var eventTypes = []string{
+	"gpu_added",
+	"gpu_removed",
+	"process_started",
+	"process_ended",
+	"throttling_started",
+	"throttling_ended",
+	"temperature_above_threshold",
+	"temperature_below_threshold",
+	"xid",
+}
+
+// clock reasons that mean the GPU is slowed down (others are idle or settings)
+var throttleReasonNames = []string{
+	"sw_power_cap",
+	"hw_slowdown",
+	"hw_thermal_slowdown",
+	"hw_power_brake_slowdown",
+	"sync_boost",
+	"sw_thermal_slowdown",
+}
+
+// ring buffer of the latest events
+var eventLog = struct {
+	sync.Mutex
+	events  []Event
+	lastId  uint64
+	changed chan struct{} // closed and replaced when events are added
+}{changed: make(chan struct{})}
+
+func publishEvents(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+	eventLog.Lock()
+	defer eventLog.Unlock()
+	for _, event := range events {
+		eventLog.lastId++
+		event.Id = eventLog.lastId
+		eventLog.events = append(eventLog.events, event)
+	}
+	if over := len(eventLog.events) - *eventBufferSize; over > 0 {
+		eventLog.events = append([]Event(nil), eventLog.events[over:]...)
+	}
+	close(eventLog.changed)
+	eventLog.changed = make(chan struct{})
+}
+
+// Events after the given id and the id to continue from, false if events were dropped
+// from the buffer already or the id is unknown (from before a restart)
+func eventsSince(id uint64) ([]Event, uint64, bool, <-chan struct{}) {
+	eventLog.Lock()
+	defer eventLog.Unlock()
+	complete := id <= eventLog.lastId && (len(eventLog.events) == 0 || eventLog.events[0].Id <= id+1)
+	var result []Event
+	for _, event := range eventLog.events {
+		if event.Id > id {
+			result = append(result, event)
+		}
+	}
+	return result, eventLog.lastId, complete, eventLog.changed
+}
+
+// Compares the snapshot with the previous one. Called from readData.
+func detectEvents(cfg *Config, prev, cur *OutputData) []Event {
+	if prev.updated.IsZero() {
+		// first collection, no changes
+		return nil
+	}
+	now := cur.updated
+	var events []Event
+	add := func(eventType string, GPU NvidiaSmiGpu, data map[string]interface{}) {
+		events = append(events, Event{Time: now, Type: eventType, GpuUUID: GPU.UUID, GpuId: shortPciId(GPU.Id), Data: data})
+	}
+
+	prevGpus := make(map[string]NvidiaSmiGpu)
+	for _, GPU := range prev.nvidiaSmiOutput.GPU {
+		prevGpus[GPU.UUID] = GPU
+	}
+	curGpus := make(map[string]bool)
+	for _, GPU := range cur.nvidiaSmiOutput.GPU {
+		curGpus[GPU.UUID] = true
+		prevGpu, ok := prevGpus[GPU.UUID]
+		if !ok {
+			add("gpu_added", GPU, map[string]interface{}{"name": GPU.ProductName})
+			continue
+		}
+
+		prevPids := make(map[int64]bool)
+		for _, process := range prevGpu.Processes.ProcessInfo {
+			prevPids[process.Pid] = true
+		}
+		curPids := make(map[int64]bool)
+		for _, process := range GPU.Processes.ProcessInfo {
+			curPids[process.Pid] = true
+			if !prevPids[process.Pid] {
+				data := map[string]interface{}{"pid": process.Pid, "type": process.Type, "name": process.ProcessName}
+				if v := parseUnit(process.UsedMemory); v.State == ValueOk {
+					data["used_memory_bytes"] = v.Value
+				}
+				add("process_started", GPU, data)
+			}
+		}
+		for _, process := range prevGpu.Processes.ProcessInfo {
+			if !curPids[process.Pid] {
+				add("process_ended", GPU, map[string]interface{}{"pid": process.Pid, "name": process.ProcessName})
+			}
+		}
+
+		prevReasons, curReasons := prevGpu.clockReasons(), GPU.clockReasons()
+		for _, name := range throttleReasonNames {
+			wasActive := parseActive(prevReasons[name]).Value == 1
+			active := parseActive(curReasons[name]).Value == 1
+			if active && !wasActive {
+				add("throttling_started", GPU, map[string]interface{}{"reason": name})
+			} else if wasActive && !active {
+				add("throttling_ended", GPU, map[string]interface{}{"reason": name})
+			}
+		}
+
+		if threshold := cfg.Events.TemperatureThreshold; threshold > 0 {
+			prevTemp, temp := parseUnit(prevGpu.Temperature.GPUTemp), parseUnit(GPU.Temperature.GPUTemp)
+			if prevTemp.State == ValueOk && temp.State == ValueOk {
+				data := map[string]interface{}{"temperature_celsius": temp.Value, "threshold_celsius": threshold}
+				if prevTemp.Value <= threshold && temp.Value > threshold {
+					add("temperature_above_threshold", GPU, data)
+				} else if prevTemp.Value > threshold && temp.Value <= threshold {
+					add("temperature_below_threshold", GPU, data)
+				}
+			}
+		}
+	}
+	for _, GPU := range prev.nvidiaSmiOutput.GPU {
+		if !curGpus[GPU.UUID] {
+			add("gpu_removed", GPU, map[string]interface{}{"name": GPU.ProductName})
+		}
+	}
+
+	// also for GPUs that are gone, e.g. Xid 79 (fallen off the bus)
+	gpusById := make(map[string]NvidiaSmiGpu)
+	for _, output := range []NvidiaSmiOutput{prev.nvidiaSmiOutput, cur.nvidiaSmiOutput} {
+		for _, GPU := range output.GPU {
+			gpusById[shortPciId(GPU.Id)] = GPU
+		}
+	}
+	gpuIds := make([]string, 0, len(cur.xidErrors))
+	for gpuId := range cur.xidErrors {
+		gpuIds = append(gpuIds, gpuId)
+	}
+	sort.Strings(gpuIds)
+	for _, gpuId := range gpuIds {
+		xids := make([]int, 0, len(cur.xidErrors[gpuId]))
+		for xid := range cur.xidErrors[gpuId] {
+			xids = append(xids, xid)
+		}
+		sort.Ints(xids)
+		for _, xid := range xids {
+			info := cur.xidErrors[gpuId][xid]
+			if count := info.Count - prev.xidErrors[gpuId][xid].Count; count > 0 {
+				GPU, ok := gpusById[gpuId]
+				if !ok {
+					GPU.Id = gpuId
+				}
+				add("xid", GPU, map[string]interface{}{"xid": xid, "count": count, "message": info.LastMessage})
+			}
+		}
+	}
+	return events
+}
+
+const eventKeepaliveInterval = 15 * time.Second
+
+// Server-sent events, resuming after the Last-Event-ID header (sent by browsers on reconnect)
+// or last_event_id parameter. If events were missed, a resync event is sent first, clients
+// should then reload the state from the other endpoints.
+func eventStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var lastId uint64
+	resume := r.Header.Get("Last-Event-ID")
+	if resume == "" {
+		resume = r.URL.Query().Get("last_event_id")
+	}
+	if resume != "" {
+		id, err := strconv.ParseUint(resume, 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid last event ID %q", resume)})
+			return
+		}
+		lastId = id
+	} else {
+		// new clients only get new events
+		eventLog.Lock()
+		lastId = eventLog.lastId
+		eventLog.Unlock()
+	}
+
+	var types map[string]bool
+	if values := r.URL.Query()["type"]; len(values) > 0 {
+		types = make(map[string]bool)
+		for _, t := range values {
+			known := false
+			for _, name := range eventTypes {
+				known = known || t == name
+			}
+			if !known {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("unknown event type %q", t)})
+				return
+			}
+			types[t] = true
+		}
+	}
+	var uuids map[string]bool
+	if values := r.URL.Query()["uuid"]; len(values) > 0 {
+		uuids = make(map[string]bool)
+		for _, uuid := range values {
+			uuids[uuid] = true
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		events, next, complete, changed := eventsSince(lastId)
+		if !complete {
+			fmt.Fprint(w, "event: resync\ndata: {}\n\n")
+		}
+		lastId = next
+		for _, event := range events {
+			if types != nil && !types[event.Type] || uuids != nil && !uuids[event.GpuUUID] {
+				continue
+			}
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data)
+		}
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
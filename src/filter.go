@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Regular expression matching whole strings, as in Prometheus relabel configs
+type Regexp struct {
+	*regexp.Regexp
+}
+
+func (re *Regexp) UnmarshalYAML(node *yaml.Node) error {
+	var s string
+	if err := node.Decode(&s); err != nil {
+		return err
+	}
+	if _, err := regexp.Compile(s); err != nil {
+		return fmt.Errorf("line %d: invalid regex %q: %v", node.Line, s, err)
+	}
+	re.Regexp = regexp.MustCompile("^(?:" + s + ")$")
+	return nil
+}
+
+// Metric names are matched including the nvidiasmi_ prefix. Labels listed in
+// include_labels/exclude_labels only affect series having them.
+type FilterConfig struct {
+	IncludeMetrics []Regexp          `yaml:"include_metrics"` // if set, only matching metrics are exposed
+	ExcludeMetrics []Regexp          `yaml:"exclude_metrics"`
+	IncludeLabels  map[string]Regexp `yaml:"include_labels"` // by label name
+	ExcludeLabels  map[string]Regexp `yaml:"exclude_labels"`
+}
+
+// Subset of Prometheus metric_relabel_configs
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    *string  `yaml:"separator"` // default ";"
+	Regex        Regexp   `yaml:"regex"`     // default "(.*)"
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  *string  `yaml:"replacement"` // default "$1"
+	Action       string   `yaml:"action"`      // replace (default), keep or drop
+}
+
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// fills in defaults
+func (rc *RelabelConfig) validate() error {
+	if rc.Separator == nil {
+		separator := ";"
+		rc.Separator = &separator
+	}
+	if rc.Regex.Regexp == nil {
+		rc.Regex.Regexp = regexp.MustCompile("^(?:(.*))$")
+	}
+	if rc.Replacement == nil {
+		replacement := "$1"
+		rc.Replacement = &replacement
+	}
+	if rc.Action == "" {
+		rc.Action = "replace"
+	}
+	switch rc.Action {
+	case "keep", "drop":
+		if len(rc.SourceLabels) == 0 {
+			return fmt.Errorf("source_labels must not be empty for action %s", rc.Action)
+		}
+	case "replace":
+		// without source_labels, the replacement is a constant
+		if !labelNameRe.MatchString(rc.TargetLabel) {
+			return fmt.Errorf("invalid target_label %q", rc.TargetLabel)
+		}
+	default:
+		return fmt.Errorf("unknown action %q, must be replace, keep or drop", rc.Action)
+	}
+	return nil
+}
+
+// Wraps the response of a scrape, writeMetric drops or rewrites series according to it
+type filterWriter struct {
+	http.ResponseWriter
+	selected     map[string]bool // collectors selected by collect[] params, nil: all
+	filters      FilterConfig
+	relabel      []RelabelConfig
+	gpuLabels    []string
+	gpus         map[string]map[string]string // identity labels by gpu_id, nil: only gpu_id
+	staticLabels map[string]string
+
+	unsupportedWritten map[string]bool // field_unsupported series by "<gpu_id> <field>"
+}
+
+// Returns an error for unknown collector names in collect[] params. "nvidia_smi" selects
+// the metrics not belonging to any collector.
+func newFilterWriter(w http.ResponseWriter, r *http.Request, cfg *Config) (*filterWriter, error) {
+	result := &filterWriter{
+		ResponseWriter: w,
+		filters:        cfg.Metrics.Filters,
+		relabel:        cfg.Metrics.RelabelConfigs,
+		staticLabels:   cfg.Labels.Static,
+
+		unsupportedWritten: make(map[string]bool),
+	}
+	if names := r.URL.Query()["collect[]"]; len(names) > 0 {
+		result.selected = make(map[string]bool)
+		for _, name := range names {
+			if _, ok := collectors[name]; !ok && name != "nvidia_smi" {
+				return nil, fmt.Errorf("unknown collector %q", name)
+			}
+			result.selected[name] = true
+		}
+	}
+	return result, nil
+}
+
+func (f *filterWriter) collectorSelected(name string) bool {
+	return f.selected == nil || f.selected[name]
+}
+
+func (f *filterWriter) nameSelected(name string) bool {
+	if f.selected == nil {
+		return true
+	}
+	short := strings.TrimPrefix(name, "nvidiasmi_")
+	if strings.HasPrefix(short, "collector_") {
+		// status of the selected collectors, see metrics()
+		return true
+	}
+	for _, entry := range collectors {
+		if entry.metrics != nil && entry.metrics.MatchString(short) {
+			return f.selected[entry.name]
+		}
+	}
+	return f.selected["nvidia_smi"]
+}
+
+// Returns the name and labels to write, or false if the series is dropped.
+// labelValues is not modified, a copy is returned if labels are changed.
+func (f *filterWriter) apply(name string, labelValues map[string]string) (string, map[string]string, bool) {
+	if !f.nameSelected(name) {
+		return "", nil, false
+	}
+	labelValues, copied := f.addLabels(name, labelValues)
+
+	if len(f.filters.IncludeMetrics) > 0 {
+		included := false
+		for _, re := range f.filters.IncludeMetrics {
+			included = included || re.MatchString(name)
+		}
+		if !included {
+			return "", nil, false
+		}
+	}
+	for _, re := range f.filters.ExcludeMetrics {
+		if re.MatchString(name) {
+			return "", nil, false
+		}
+	}
+	for label, re := range f.filters.IncludeLabels {
+		if value, ok := labelValues[label]; ok && !re.MatchString(value) {
+			return "", nil, false
+		}
+	}
+	for label, re := range f.filters.ExcludeLabels {
+		if value, ok := labelValues[label]; ok && re.MatchString(value) {
+			return "", nil, false
+		}
+	}
+
+	for _, rc := range f.relabel {
+		values := make([]string, len(rc.SourceLabels))
+		for i, label := range rc.SourceLabels {
+			if label == "__name__" {
+				values[i] = name
+			} else {
+				values[i] = labelValues[label]
+			}
+		}
+		value := strings.Join(values, *rc.Separator)
+
+		switch rc.Action {
+		case "keep":
+			if !rc.Regex.MatchString(value) {
+				return "", nil, false
+			}
+		case "drop":
+			if rc.Regex.MatchString(value) {
+				return "", nil, false
+			}
+		case "replace":
+			match := rc.Regex.FindStringSubmatchIndex(value)
+			if match == nil {
+				continue
+			}
+			target := string(rc.Regex.ExpandString(nil, *rc.Replacement, value, match))
+			if rc.TargetLabel == "__name__" {
+				if target != "" {
+					name = target
+				}
+				continue
+			}
+			if !copied {
+				labels := make(map[string]string, len(labelValues)+1)
+				for k, v := range labelValues {
+					labels[k] = v
+				}
+				labelValues = labels
+				copied = true
+			}
+			if target == "" {
+				delete(labelValues, rc.TargetLabel)
+			} else {
+				labelValues[rc.TargetLabel] = target
+			}
+		}
+	}
+	return name, labelValues, true
+}
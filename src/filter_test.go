@@ -0,0 +1,251 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// filterWriter for the given config file content and query string
+func newTestFilterWriter(t *testing.T, config string, query string) *filterWriter {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "filter_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(file, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := newFilterWriter(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics?"+query, nil), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.setGpus(cfg, []NvidiaSmiGpu{
+		{Id: "00000000:46:00.0", UUID: "GPU-a", ProductName: "NVIDIA GeForce RTX 3090"},
+		{Id: "00000000:81:00.0", UUID: "GPU-b", ProductName: "NVIDIA GeForce RTX 4090"},
+	})
+	return f
+}
+
+type filterCase struct {
+	name       string
+	labels     map[string]string
+	wantName   string // empty: dropped
+	wantLabels map[string]string
+}
+
+func checkFilter(t *testing.T, f *filterWriter, tests []filterCase) {
+	t.Helper()
+	for _, tt := range tests {
+		var before map[string]string
+		if tt.labels != nil {
+			before = make(map[string]string)
+			for k, v := range tt.labels {
+				before[k] = v
+			}
+		}
+		name, labels, ok := f.apply(tt.name, tt.labels)
+		if !reflect.DeepEqual(tt.labels, before) {
+			t.Errorf("%s%v: labels of the series modified to %v", tt.name, before, tt.labels)
+		}
+		if tt.wantName == "" {
+			if ok {
+				t.Errorf("%s%v: kept as %s%v, want dropped", tt.name, tt.labels, name, labels)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s%v: dropped, want %s%v", tt.name, tt.labels, tt.wantName, tt.wantLabels)
+			continue
+		}
+		if name != tt.wantName || !reflect.DeepEqual(labels, tt.wantLabels) {
+			t.Errorf("%s%v: got %s%v, want %s%v", tt.name, tt.labels, name, labels, tt.wantName, tt.wantLabels)
+		}
+	}
+}
+
+func TestFilterIncludeExclude(t *testing.T) {
+	f := newTestFilterWriter(t, `
+metrics:
+  filters:
+    include_metrics: ['nvidiasmi_gpu_.*', 'nvidiasmi_aer_.*']
+    exclude_metrics: ['nvidiasmi_gpu_temp_.*']
+    include_labels: {aer_type: 'fatal|non-fatal'}
+    exclude_labels: {gpu_id: '81:00.0'}
+`, "")
+	gpu := map[string]string{"gpu_id": "46:00.0"}
+	checkFilter(t, f, []filterCase{
+		{"nvidiasmi_gpu_utilization", gpu, "nvidiasmi_gpu_utilization", gpu},
+		// not included
+		{"nvidiasmi_memory_used_bytes", gpu, "", nil},
+		// excluded although included
+		{"nvidiasmi_gpu_temp_celsius", gpu, "", nil},
+		// excluded by label value
+		{"nvidiasmi_gpu_utilization", map[string]string{"gpu_id": "81:00.0"}, "", nil},
+		// label filters only apply to series having the label
+		{"nvidiasmi_aer_counter", map[string]string{"gpu_id": "46:00.0", "aer_type": "fatal"}, "nvidiasmi_aer_counter", map[string]string{"gpu_id": "46:00.0", "aer_type": "fatal"}},
+		{"nvidiasmi_aer_counter", map[string]string{"gpu_id": "46:00.0", "aer_type": "correctable"}, "", nil},
+		// regexes match whole names
+		{"nvidiasmi_xgpu_utilization", gpu, "", nil},
+	})
+}
+
+func TestFilterRelabel(t *testing.T) {
+	f := newTestFilterWriter(t, `
+metrics:
+  relabel_configs:
+    - source_labels: [__name__]
+      regex: 'nvidiasmi_aer_.*'
+      action: drop
+    - source_labels: [gpu_id]
+      regex: '(\w+):(\w+)\.0'
+      target_label: bus
+      replacement: 'bus-$1'
+    - source_labels: [__name__, gpu_id]
+      separator: '@'
+      regex: 'nvidiasmi_gpu_temp_celsius@46:00.0'
+      target_label: __name__
+      replacement: nvidiasmi_hot_gpu_temp_celsius
+    - source_labels: [driver_version]
+      regex: '.*'
+      target_label: driver_version
+      replacement: ''
+    - source_labels: [gpu_id]
+      regex: '46:00.0|'
+      action: keep
+    - target_label: env
+      replacement: prod
+`, "")
+	checkFilter(t, f, []filterCase{
+		{"nvidiasmi_aer_counter", map[string]string{"gpu_id": "46:00.0"}, "", nil},
+		// capture groups, rename by __name__ with separator
+		{"nvidiasmi_gpu_temp_celsius", map[string]string{"gpu_id": "46:00.0"},
+			"nvidiasmi_hot_gpu_temp_celsius", map[string]string{"gpu_id": "46:00.0", "bus": "bus-46", "env": "prod"}},
+		// keep drops other GPUs, series without the label have an empty value
+		{"nvidiasmi_gpu_temp_celsius", map[string]string{"gpu_id": "81:00.0"}, "", nil},
+		// an empty replacement removes the label
+		{"nvidiasmi_info", map[string]string{"driver_version": "550.90.07"}, "nvidiasmi_info", map[string]string{"env": "prod"}},
+		// a replace rule without source labels sets a constant
+		{"nvidiasmi_cc_gpu_ready", nil, "nvidiasmi_cc_gpu_ready", map[string]string{"env": "prod"}},
+	})
+}
+
+// identity labels first, then collect[], filters and relabel rules in order
+func TestFilterOrder(t *testing.T) {
+	f := newTestFilterWriter(t, `
+labels:
+  gpu: [gpu_uuid]
+  static: {cluster: a}
+metrics:
+  filters:
+    exclude_labels: {gpu_uuid: GPU-b}
+  relabel_configs:
+    - source_labels: [gpu_uuid]
+      regex: 'GPU-(.*)'
+      target_label: gpu_uuid
+      replacement: '$1'
+    # a filter on the renamed metric does not apply, filters run before relabel rules
+    - source_labels: [__name__]
+      regex: 'nvidiasmi_gpu_utilization'
+      target_label: __name__
+      replacement: nvidiasmi_gpu_temp_celsius
+`, "collect[]=nvidia_smi")
+	checkFilter(t, f, []filterCase{
+		{"nvidiasmi_gpu_utilization", map[string]string{"gpu_id": "46:00.0"},
+			"nvidiasmi_gpu_temp_celsius", map[string]string{"gpu_uuid": "a", "cluster": "a"}},
+		// filtered by an identity label
+		{"nvidiasmi_gpu_utilization", map[string]string{"gpu_id": "81:00.0"}, "", nil},
+		// gpu_info keeps gpu_id, labels of the series take precedence over static labels
+		{"nvidiasmi_gpu_info", map[string]string{"gpu_id": "46:00.0", "cluster": "b"},
+			"nvidiasmi_gpu_info", map[string]string{"gpu_id": "46:00.0", "gpu_uuid": "a", "cluster": "b"}},
+		// not selected by collect[]
+		{"nvidiasmi_aer_counter", map[string]string{"gpu_id": "46:00.0"}, "", nil},
+		// collector status is always written for the selected collectors
+		{"nvidiasmi_collector_success", map[string]string{"collector": "aer"},
+			"nvidiasmi_collector_success", map[string]string{"collector": "aer", "cluster": "a"}},
+	})
+}
+
+func TestFilterCollect(t *testing.T) {
+	f := newTestFilterWriter(t, "", "collect[]=aer&collect[]=xid")
+	if !f.collectorSelected("aer") || f.collectorSelected("gddr6") || f.collectorSelected("nvidia_smi") {
+		t.Errorf("selected %v", f.selected)
+	}
+	for name, want := range map[string]bool{
+		"nvidiasmi_aer_counter":        true,
+		"nvidiasmi_bridge_aer_counter": true,
+		"nvidiasmi_xid_errors_total":   true,
+		"nvidiasmi_gpu_temp_celsius":   false,
+		"nvidiasmi_nvlink_state":       false,
+		"nvidiasmi_collector_success":  true,
+	} {
+		if got := f.nameSelected(name); got != want {
+			t.Errorf("%s selected: %v, want %v", name, got, want)
+		}
+	}
+
+	cfg, _ := loadConfig("")
+	if _, err := newFilterWriter(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics?collect[]=foo", nil), cfg); err == nil {
+		t.Error("expected an error for an unknown collector")
+	}
+}
+
+func TestCollectorsCovered(t *testing.T) {
+	all := map[string]bool(nil)
+	aer := map[string]bool{"aer": true}
+	aerXid := map[string]bool{"aer": true, "xid": true}
+	tests := []struct {
+		a, b map[string]bool
+		want bool
+	}{
+		{all, all, true},
+		{all, aer, true},
+		{aer, all, false},
+		{aerXid, aer, true},
+		{aer, aerXid, false},
+	}
+	for _, tt := range tests {
+		if got := collectorsCovered(tt.a, tt.b); got != tt.want {
+			t.Errorf("collectorsCovered(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// listed once per GPU and field, without the other labels of the series
+func TestFieldUnsupported(t *testing.T) {
+	prevConfig := currentConfig()
+	defer setConfig(prevConfig)
+	for _, asZero := range []bool{false, true} {
+		cfg := *prevConfig
+		cfg.Metrics.UnsupportedAsZero = asZero
+		setConfig(&cfg)
+		f := newTestFilterWriter(t, "", "")
+		for _, cause := range []string{"single_bit_ecc", "double_bit_ecc"} {
+			writeValue(f, "retired_pages_count", map[string]string{"gpu_id": "46:00.0", "cause": cause}, parseNumber("N/A"))
+		}
+		writeValue(f, "retired_pages_count", map[string]string{"gpu_id": "81:00.0", "cause": "single_bit_ecc"}, parseNumber("[Not Supported]"))
+		writeValue(f, "retired_pages_pending", map[string]string{"gpu_id": "46:00.0"}, parseNumber(""))
+
+		want := `nvidiasmi_field_unsupported{field="retired_pages_count",gpu_id="46:00.0"} 1
+nvidiasmi_field_unsupported{field="retired_pages_count",gpu_id="81:00.0"} 1
+`
+		if asZero {
+			want = `nvidiasmi_retired_pages_count{cause="single_bit_ecc",gpu_id="46:00.0"} 0
+nvidiasmi_retired_pages_count{cause="double_bit_ecc",gpu_id="46:00.0"} 0
+nvidiasmi_retired_pages_count{cause="single_bit_ecc",gpu_id="81:00.0"} 0
+`
+		}
+		if got := f.ResponseWriter.(*httptest.ResponseRecorder).Body.String(); got != want {
+			t.Errorf("unsupported as zero %v: got\n%swant\n%s", asZero, got, want)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+)
+
+/*
+Expected versions, first rule whose product glob matches the GPU name applies.
+Versions are globs as well, components missing in a rule are not checked:
+
+{
+  "rules": [
+    {
+      "product": "NVIDIA GeForce RTX 4090",
+      "versions": {"driver": "550.90.07", "vbios": "95.02.*"}
+    }
+  ]
+}
+*/
+
+type FirmwareRule struct {
+	Product  string            `json:"product" yaml:"product"`
+	Versions map[string]string `json:"versions" yaml:"versions"` // by component
+}
+
+type FirmwarePolicy struct {
+	Rules []FirmwareRule `json:"rules" yaml:"rules"`
+}
+
+var firmwareComponentNames = []string{"vbios", "inforom_img", "inforom_oem", "inforom_ecc", "inforom_pwr", "gsp", "driver"}
+
+func loadFirmwarePolicy(file string) (*FirmwarePolicy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var policy FirmwarePolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if err := policy.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return &policy, nil
+}
+
+func (policy *FirmwarePolicy) validate() error {
+	known := make(map[string]bool)
+	for _, name := range firmwareComponentNames {
+		known[name] = true
+	}
+	for i, rule := range policy.Rules {
+		if _, err := path.Match(rule.Product, ""); err != nil {
+			return fmt.Errorf("rule %d: bad product pattern %q", i+1, rule.Product)
+		}
+		for component, version := range rule.Versions {
+			if !known[component] {
+				return fmt.Errorf("rule %d: unknown component %q", i+1, component)
+			}
+			if _, err := path.Match(version, ""); err != nil {
+				return fmt.Errorf("rule %d: bad version pattern %q", i+1, version)
+			}
+		}
+	}
+	return nil
+}
+
+func (policy *FirmwarePolicy) rule(productName string) *FirmwareRule {
+	for i, rule := range policy.Rules {
+		if ok, _ := path.Match(rule.Product, productName); ok {
+			return &policy.Rules[i]
+		}
+	}
+	return nil
+}
+
+// versions by component, unavailable ones (N/A on GeForce etc.) are left out
+func firmwareVersions(driverVersion string, GPU NvidiaSmiGpu) map[string]string {
+	result := make(map[string]string)
+	for component, version := range map[string]string{
+		"vbios":       GPU.VbiosVersion,
+		"inforom_img": GPU.InfoRomVersion.ImgVersion,
+		"inforom_oem": GPU.InfoRomVersion.OemObject,
+		"inforom_ecc": GPU.InfoRomVersion.EccObject,
+		"inforom_pwr": GPU.InfoRomVersion.PwrObject,
+		"gsp":         GPU.GSPFirmwareVersion,
+		"driver":      driverVersion,
+	} {
+		if fieldState(version) == ValueOk {
+			result[component] = version
+		}
+	}
+	return result
+}
+
+func writeFirmwareMetrics(w http.ResponseWriter, labelValues map[string]string, driverVersion string, GPU NvidiaSmiGpu) {
+	versions := firmwareVersions(driverVersion, GPU)
+	for _, component := range firmwareComponentNames {
+		if version, ok := versions[component]; ok {
+			labelValues["component"] = component
+			labelValues["version"] = version
+			writeMetric(w, "firmware_info", labelValues, "1.0")
+		}
+	}
+	delete(labelValues, "component")
+	delete(labelValues, "version")
+
+	policy := currentConfig().FirmwarePolicy
+	if policy == nil {
+		return
+	}
+	rule := policy.rule(GPU.ProductName)
+	if rule == nil {
+		return
+	}
+
+	components := make([]string, 0, len(rule.Versions))
+	for component := range rule.Versions {
+		components = append(components, component)
+	}
+	sort.Strings(components)
+
+	compliant := "1"
+	for _, component := range components {
+		expected := rule.Versions[component]
+		actual, ok := versions[component]
+		if ok {
+			if match, _ := path.Match(expected, actual); match {
+				continue
+			}
+		} else {
+			actual = "N/A"
+		}
+		compliant = "0"
+		labelValues2 := map[string]string{
+			"gpu_id":    labelValues["gpu_id"],
+			"component": component,
+			"expected":  expected,
+			"actual":    actual,
+		}
+		writeMetric(w, "firmware_mismatch", labelValues2, "1")
+	}
+	writeMetric(w, "firmware_compliant", labelValues, compliant)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,8 +14,8 @@ type Gddr6Output []struct {
 	Temp  int    `json:"temp"`
 }
 
-func getGddr6Temperatures() (map[string]int, error) {
-	if _, err := os.Stat(*gddr6Path); errors.Is(err, os.ErrNotExist) {
+func getGddr6Temperatures(ctx context.Context, gddr6Path string) (map[string]int, error) {
+	if _, err := os.Stat(gddr6Path); errors.Is(err, os.ErrNotExist) {
 		return nil, nil
 	}
 
@@ -22,7 +23,7 @@ func getGddr6Temperatures() (map[string]int, error) {
 	var stdout []byte
 	var err error
 
-	cmd := exec.Command(*gddr6Path, "-j")
+	cmd := exec.CommandContext(ctx, gddr6Path, "-j")
 	stdout, err = cmd.Output()
 	if err != nil {
 		return nil, err
@@ -38,3 +39,19 @@ func getGddr6Temperatures() (map[string]int, error) {
 	}
 	return result, nil
 }
+
+func init() {
+	registerCollector("gddr6", true, "VRAM temperatures of GDDR6(X) GPUs from the gddr6 tool", "", &gddr6Collector{})
+}
+
+type gddr6Collector struct{}
+
+func (c *gddr6Collector) Update(ctx context.Context, core *OutputData) (func(*OutputData), error) {
+	temperatures, err := getGddr6Temperatures(ctx, currentConfig().Sources.Gddr6Path)
+	if err != nil {
+		return nil, err
+	}
+	return func(data *OutputData) {
+		data.temperatures = temperatures
+	}, nil
+}
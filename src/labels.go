@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/common/log"
+)
+
+// Labels identifying a GPU, per-GPU series get the configured ones instead of gpu_id
+var gpuIdentityLabelNames = []string{"gpu_id", "gpu_uuid", "gpu_index", "gpu_minor_number", "serial", "gpu_name"}
+
+type LabelsConfig struct {
+	Gpu      []string          `yaml:"gpu"`      // identity labels of per-GPU series, default gpu_id
+	Static   map[string]string `yaml:"static"`   // added to every series, e.g. cluster, rack
+	Hostname bool              `yaml:"hostname"` // add hostname label with the name of this host
+}
+
+// index is the position in nvidia-smi output (same as nvidia-smi -i)
+func gpuIdentity(index int, GPU NvidiaSmiGpu) map[string]string {
+	return map[string]string{
+		"gpu_id":           shortPciId(GPU.Id),
+		"gpu_uuid":         GPU.UUID,
+		"gpu_index":        strconv.Itoa(index),
+		"gpu_minor_number": GPU.MinorNumber,
+		"serial":           GPU.Serial,
+		"gpu_name":         GPU.ProductName,
+	}
+}
+
+// logged once per set of labels, not on every scrape
+var (
+	ambiguousGpuLabelsMutex  sync.Mutex
+	ambiguousGpuLabelsLogged = make(map[string]bool)
+)
+
+// called with the GPUs of the data written, series with a gpu_id label get the
+// configured identity labels of the GPU
+func (f *filterWriter) setGpus(cfg *Config, gpus []NvidiaSmiGpu) {
+	if len(cfg.Labels.Gpu) == 1 && cfg.Labels.Gpu[0] == "gpu_id" {
+		return
+	}
+	f.gpuLabels = cfg.Labels.Gpu
+	f.gpus = make(map[string]map[string]string)
+	seen := make(map[string]bool)
+	unique := true
+	for i, GPU := range gpus {
+		identity := gpuIdentity(i, GPU)
+		f.gpus[identity["gpu_id"]] = identity
+
+		var key []string
+		for _, label := range f.gpuLabels {
+			key = append(key, identity[label])
+		}
+		unique = unique && !seen[strings.Join(key, "\x00")]
+		seen[strings.Join(key, "\x00")] = true
+	}
+
+	// e.g. gpu_name on hosts with several GPUs of a kind, or serial (N/A on GeForce cards):
+	// series of different GPUs would be identical
+	if !unique {
+		labels := strings.Join(f.gpuLabels, ",")
+		f.gpuLabels = append(append([]string(nil), f.gpuLabels...), "gpu_uuid")
+		ambiguousGpuLabelsMutex.Lock()
+		if !ambiguousGpuLabelsLogged[labels] {
+			ambiguousGpuLabelsLogged[labels] = true
+			log.Errorf("GPU labels %s do not identify GPUs uniquely, adding gpu_uuid", labels)
+		}
+		ambiguousGpuLabelsMutex.Unlock()
+	}
+}
+
+// Returns labelValues with identity and static labels, copied if changed.
+func (f *filterWriter) addLabels(name string, labelValues map[string]string) (map[string]string, bool) {
+	identity, isGpu := f.gpus[labelValues["gpu_id"]]
+	if !isGpu && len(f.staticLabels) == 0 {
+		return labelValues, false
+	}
+
+	labels := make(map[string]string, len(labelValues)+len(f.gpuLabels)+len(f.staticLabels))
+	for k, v := range labelValues {
+		labels[k] = v
+	}
+	if isGpu {
+		// gpu_info lists all of them
+		if name != "nvidiasmi_gpu_info" {
+			delete(labels, "gpu_id")
+		}
+		for _, label := range f.gpuLabels {
+			labels[label] = identity[label]
+		}
+	}
+	// labels of the series take precedence
+	for k, v := range f.staticLabels {
+		if _, ok := labels[k]; !ok {
+			labels[k] = v
+		}
+	}
+	return labels, true
+}
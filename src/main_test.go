@@ -0,0 +1,17 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// flags with their defaults, as loadConfig starts from them
+func TestMain(m *testing.M) {
+	if _, err := kingpin.CommandLine.Parse(nil); err != nil {
+		panic(err)
+	}
+	setConfig(configFromFlags())
+	os.Exit(m.Run())
+}
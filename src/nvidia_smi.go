@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
 	"os/exec"
 	"regexp"
 	"strconv"
+	"strings"
 )
 
 /*
@@ -15,195 +17,311 @@ SKIPPED TAGS:
 	<mig_devices>
 	<ecc_mode>
 	<ecc_errors>
-	<retired_pages>
-	<remapped_rows>
-	<applications_clocks>
-	<default_applications_clocks>
-	<max_customer_boost_clocks>
-	<supported_clocks>
 	<accounted_processes>
 */
 
 type NvidiaSmiOutput struct {
-	DriverVersion string `xml:"driver_version"`
-	CudaVersion   string `xml:"cuda_version"`
-	AttachedGPUs  string `xml:"attached_gpus"`
-	GPU           []struct {
-		Id                       string `xml:"id,attr"`
-		ProductName              string `xml:"product_name"`
-		ProductBrand             string `xml:"product_brand"`
-		ProductArchitecture      string `xml:"product_architecture"`
-		DisplayMode              string `xml:"display_mode"`
-		DisplayActive            string `xml:"display_active"`
-		PersistenceMode          string `xml:"persistence_mode"`
-		AccountingMode           string `xml:"accounting_mode"`
-		AccountingModeBufferSize string `xml:"accounting_mode_buffer_size"`
-		DriverModel              struct {
-			CurrentDM string `xml:"current_dm"`
-			PendingDM string `xml:"pending_dm"`
-		} `xml:"driver_model"`
-		Serial         string `xml:"serial"`
-		UUID           string `xml:"uuid"`
-		MinorNumber    string `xml:"minor_number"`
-		VbiosVersion   string `xml:"vbios_version"`
-		MultiGPUBoard  string `xml:"multigpu_board"`
-		BoardId        string `xml:"board_id"`
-		GPUPartNumber  string `xml:"gpu_part_number"`
-		InfoRomVersion struct {
-			ImgVersion string `xml:"img_version"`
-			OemObject  string `xml:"oem_object"`
-			EccObject  string `xml:"ecc_object"`
-			PwrObject  string `xml:"pwr_object"`
-		} `xml:"inforom_version"`
-		GPUOperationMode struct {
-			Current string `xml:"current_gom"`
-			Pending string `xml:"pending_gom"`
-		} `xml:"gpu_operation_mode"`
-		GPUVirtualizationMode struct {
-			VirtualizationMode string `xml:"virtualization_mode"`
-			HostVGPUMode       string `xml:"host_vgpu_mode"`
-		} `xml:"gpu_virtualization_mode"`
-		IBMNPU struct {
-			RelaxedOrderingMode string `xml:"relaxed_ordering_mode"`
-		} `xml:"ibmnpu"`
-		PCI struct {
-			Bus         string `xml:"pci_bus"`
-			Device      string `xml:"pci_device"`
-			Domain      string `xml:"pci_domain"`
-			DeviceId    string `xml:"pci_device_id"`
-			BusId       string `xml:"pci_bus_id"`
-			SubSystemId string `xml:"pci_sub_system_id"`
-			GPULinkInfo struct {
-				PCIeGen struct {
-					Max     string `xml:"max_link_gen"`
-					Current string `xml:"current_link_gen"`
-				} `xml:"pcie_gen"`
-				LinkWidth struct {
-					Max     string `xml:"max_link_width"`
-					Current string `xml:"current_link_width"`
-				} `xml:"link_widths"`
-			} `xml:"pci_gpu_link_info"`
-			BridgeChip struct {
-				Type string `xml:"bridge_chip_type"`
-				Fw   string `xml:"bridge_chip_fw"`
-			} `xml:"pci_bridge_chip"`
-			ReplayCounter         string `xml:"replay_counter"`
-			ReplayRolloverCounter string `xml:"replay_rollover_counter"`
-			TxUtil                string `xml:"tx_util"`
-			RxUtil                string `xml:"rx_util"`
-		} `xml:"pci"`
-		FanSpeed             string `xml:"fan_speed"`
-		PerformanceState     string `xml:"performance_state"`
-		ClockThrottleReasons struct {
-			ClockThrottleReasonGPUIdle                   string `xml:"clocks_throttle_reason_gpu_idle"`
-			ClockThrottleReasonApplicationsClocksSetting string `xml:"clocks_throttle_reason_applications_clocks_setting"`
-			ClockThrottleReasonSWPowerCap                string `xml:"clocks_throttle_reason_sw_power_cap"`
-			ClockThrottleReasonHWSlowdown                string `xml:"clocks_throttle_reason_hw_slowdown"`
-			ClockThrottleReasonHWThermalSlowdown         string `xml:"clocks_throttle_reason_hw_thermal_slowdown"`
-			ClockThrottleReasonHWPowerBrakeSlowdown      string `xml:"clocks_throttle_reason_hw_power_brake_slowdown"`
-			ClockThrottleReasonSyncBoost                 string `xml:"clocks_throttle_reason_sync_boost"`
-			ClockThrottleReasonSWThermalSlowdown         string `xml:"clocks_throttle_reason_sw_thermal_slowdown"`
-			ClockThrottleReasonDisplayClocksSetting      string `xml:"clocks_throttle_reason_display_clocks_setting"`
-		} `xml:"clocks_throttle_reasons"`
-		FbMemoryUsage struct {
-			Total string `xml:"total"`
-			Used  string `xml:"used"`
-			Free  string `xml:"free"`
-		} `xml:"fb_memory_usage"`
-		Bar1MemoryUsage struct {
-			Total string `xml:"total"`
-			Used  string `xml:"used"`
-			Free  string `xml:"free"`
-		} `xml:"bar1_memory_usage"`
-		ComputeMode string `xml:"compute_mode"`
-		Utilization struct {
-			GPUUtil     string `xml:"gpu_util"`
-			MemoryUtil  string `xml:"memory_util"`
-			EncoderUtil string `xml:"encoder_util"`
-			DecoderUtil string `xml:"decoder_util"`
-		} `xml:"utilization"`
-		EncoderStats struct {
-			SessionCount   string `xml:"session_count"`
-			AverageFPS     string `xml:"average_fps"`
-			AverageLatency string `xml:"average_latency"`
-		} `xml:"encoder_stats"`
-		FBCStats struct {
-			SessionCount   string `xml:"session_count"`
-			AverageFPS     string `xml:"average_fps"`
-			AverageLatency string `xml:"average_latency"`
-		} `xml:"fbc_stats"`
-		Temperature struct {
-			GPUTemp                string `xml:"gpu_temp"`
-			GPUTempMaxThreshold    string `xml:"gpu_temp_max_threshold"`
-			GPUTempSlowThreshold   string `xml:"gpu_temp_slow_threshold"`
-			GPUTempMaxGpuThreshold string `xml:"gpu_temp_max_gpu_threshold"`
-			GPUTargetTemperature   string `xml:"gpu_target_temperature"`
-			MemoryTemp             string `xml:"memory_temp"`
-			GPUTempMaxMemThreshold string `xml:"gpu_temp_max_mem_threshold"`
-		} `xml:"temperature"`
-		SupportedGPUTargetTemp struct {
-			GPUTargetTempMin string `xml:"gpu_target_temp_min"`
-			GPUTargetTempMax string `xml:"gpu_target_temp_max"`
-		}
-		PowerReadings struct { // backwards compatibility
-			PowerState         string `xml:"power_state"`
-			PowerManagement    string `xml:"power_management"`
-			PowerDraw          string `xml:"power_draw"`
-			PowerLimit         string `xml:"power_limit"`
-			DefaultPowerLimit  string `xml:"default_power_limit"`
-			EnforcedPowerLimit string `xml:"enforced_power_limit"`
-			MinPowerLimit      string `xml:"min_power_limit"`
-			MaxPowerLimit      string `xml:"max_power_limit"`
-		} `xml:"power_readings"`
-		GPUPowerReadings struct {
-			PowerState          string `xml:"power_state"`
-			PowerDraw           string `xml:"power_draw"`
-			CurrentPowerLimit   string `xml:"current_power_limit"`
-			RequestedPowerLimit string `xml:"requested_power_limit"`
-			DefaultPowerLimit   string `xml:"default_power_limit"`
-			MinPowerLimit       string `xml:"min_power_limit"`
-			MaxPowerLimit       string `xml:"max_power_limit"`
-		} `xml:"gpu_power_readings"`
-		Clocks struct {
-			GraphicsClock string `xml:"graphics_clock"`
-			SmClock       string `xml:"sm_clock"`
-			MemClock      string `xml:"mem_clock"`
-			VideoClock    string `xml:"video_clock"`
-		} `xml:"clocks"`
-		MaxClocks struct {
-			GraphicsClock string `xml:"graphics_clock"`
-			SmClock       string `xml:"sm_clock"`
-			MemClock      string `xml:"mem_clock"`
-			VideoClock    string `xml:"video_clock"`
-		} `xml:"max_clocks"`
-		ClockPolicy struct {
-			AutoBoost        string `xml:"auto_boost"`
-			AutoBoostDefault string `xml:"auto_boost_default"`
-		} `xml:"clock_policy"`
-		Processes struct {
-			ProcessInfo []struct {
-				Pid         int64  `xml:"pid"`
-				Type        string `xml:"type"`
-				ProcessName string `xml:"process_name"`
-				UsedMemory  string `xml:"used_memory"`
-			} `xml:"process_info"`
-		} `xml:"processes"`
-	} `xml:"gpu"`
+	DriverVersion string         `xml:"driver_version"`
+	CudaVersion   string         `xml:"cuda_version"`
+	AttachedGPUs  string         `xml:"attached_gpus"`
+	GPU           []NvidiaSmiGpu `xml:"gpu"`
 }
 
-func readNvidiaSmiOutput() (NvidiaSmiOutput, error) {
-	var t NvidiaSmiOutput
-	var stdout []byte
-	var err error
+type NvidiaSmiGpu struct {
+	Id                       string `xml:"id,attr"`
+	ProductName              string `xml:"product_name"`
+	ProductBrand             string `xml:"product_brand"`
+	ProductArchitecture      string `xml:"product_architecture"`
+	DisplayMode              string `xml:"display_mode"`
+	DisplayActive            string `xml:"display_active"`
+	PersistenceMode          string `xml:"persistence_mode"`
+	AccountingMode           string `xml:"accounting_mode"`
+	AccountingModeBufferSize string `xml:"accounting_mode_buffer_size"`
+	DriverModel              struct {
+		CurrentDM string `xml:"current_dm"`
+		PendingDM string `xml:"pending_dm"`
+	} `xml:"driver_model"`
+	Serial          string `xml:"serial"`
+	UUID            string `xml:"uuid"`
+	MinorNumber     string `xml:"minor_number"`
+	VbiosVersion    string `xml:"vbios_version"`
+	MultiGPUBoard   string `xml:"multigpu_board"`
+	BoardId         string `xml:"board_id"`
+	BoardPartNumber string `xml:"board_part_number"`
+	GPUPartNumber   string `xml:"gpu_part_number"`
+	InfoRomVersion  struct {
+		ImgVersion string `xml:"img_version"`
+		OemObject  string `xml:"oem_object"`
+		EccObject  string `xml:"ecc_object"`
+		PwrObject  string `xml:"pwr_object"`
+	} `xml:"inforom_version"`
+	GSPFirmwareVersion string `xml:"gsp_firmware_version"`
+	GPUOperationMode   struct {
+		Current string `xml:"current_gom"`
+		Pending string `xml:"pending_gom"`
+	} `xml:"gpu_operation_mode"`
+	GPUVirtualizationMode struct {
+		VirtualizationMode string `xml:"virtualization_mode"`
+		HostVGPUMode       string `xml:"host_vgpu_mode"`
+	} `xml:"gpu_virtualization_mode"`
+	IBMNPU struct {
+		RelaxedOrderingMode string `xml:"relaxed_ordering_mode"`
+	} `xml:"ibmnpu"`
+	PCI struct {
+		Bus         string `xml:"pci_bus"`
+		Device      string `xml:"pci_device"`
+		Domain      string `xml:"pci_domain"`
+		DeviceId    string `xml:"pci_device_id"`
+		BusId       string `xml:"pci_bus_id"`
+		SubSystemId string `xml:"pci_sub_system_id"`
+		GPULinkInfo struct {
+			PCIeGen struct {
+				Max     string `xml:"max_link_gen"`
+				Current string `xml:"current_link_gen"`
+			} `xml:"pcie_gen"`
+			LinkWidth struct {
+				Max     string `xml:"max_link_width"`
+				Current string `xml:"current_link_width"`
+			} `xml:"link_widths"`
+		} `xml:"pci_gpu_link_info"`
+		BridgeChip struct {
+			Type string `xml:"bridge_chip_type"`
+			Fw   string `xml:"bridge_chip_fw"`
+		} `xml:"pci_bridge_chip"`
+		ReplayCounter         string `xml:"replay_counter"`
+		ReplayRolloverCounter string `xml:"replay_rollover_counter"`
+		TxUtil                string `xml:"tx_util"`
+		RxUtil                string `xml:"rx_util"`
+	} `xml:"pci"`
+	FanSpeed             string       `xml:"fan_speed"`
+	PerformanceState     string       `xml:"performance_state"`
+	ClockThrottleReasons ClockReasons `xml:"clocks_throttle_reasons"`
+	ClockEventReasons    ClockReasons `xml:"clocks_event_reasons"` // newer drivers
+	FbMemoryUsage        struct {
+		Total    string `xml:"total"`
+		Reserved string `xml:"reserved"`
+		Used     string `xml:"used"`
+		Free     string `xml:"free"`
+	} `xml:"fb_memory_usage"`
+	Bar1MemoryUsage struct {
+		Total string `xml:"total"`
+		Used  string `xml:"used"`
+		Free  string `xml:"free"`
+	} `xml:"bar1_memory_usage"`
+	CcProtectedMemoryUsage struct {
+		Total string `xml:"total"`
+		Used  string `xml:"used"`
+		Free  string `xml:"free"`
+	} `xml:"cc_protected_memory_usage"` // confidential computing
+	ComputeMode string `xml:"compute_mode"`
+	Utilization struct {
+		GPUUtil     string `xml:"gpu_util"`
+		MemoryUtil  string `xml:"memory_util"`
+		EncoderUtil string `xml:"encoder_util"`
+		DecoderUtil string `xml:"decoder_util"`
+		JpegUtil    string `xml:"jpeg_util"`
+		OfaUtil     string `xml:"ofa_util"`
+	} `xml:"utilization"`
+	EncoderStats struct {
+		SessionCount   string `xml:"session_count"`
+		AverageFPS     string `xml:"average_fps"`
+		AverageLatency string `xml:"average_latency"`
+	} `xml:"encoder_stats"`
+	FBCStats struct {
+		SessionCount   string `xml:"session_count"`
+		AverageFPS     string `xml:"average_fps"`
+		AverageLatency string `xml:"average_latency"`
+	} `xml:"fbc_stats"`
+	Temperature struct {
+		GPUTemp                string `xml:"gpu_temp"`
+		GPUTempMaxThreshold    string `xml:"gpu_temp_max_threshold"`
+		GPUTempSlowThreshold   string `xml:"gpu_temp_slow_threshold"`
+		GPUTempMaxGpuThreshold string `xml:"gpu_temp_max_gpu_threshold"`
+		GPUTargetTemperature   string `xml:"gpu_target_temperature"`
+		MemoryTemp             string `xml:"memory_temp"`
+		GPUTempMaxMemThreshold string `xml:"gpu_temp_max_mem_threshold"`
+		// Ada and later
+		GPUTempTLimit                string `xml:"gpu_temp_tlimit"`
+		GPUTempMaxTLimitThreshold    string `xml:"gpu_temp_max_tlimit_threshold"`
+		GPUTempSlowTLimitThreshold   string `xml:"gpu_temp_slow_tlimit_threshold"`
+		GPUTempMaxGpuTLimitThreshold string `xml:"gpu_temp_max_gpu_tlimit_threshold"`
+		GPUTempMaxMemTLimitThreshold string `xml:"gpu_temp_max_mem_tlimit_threshold"`
+	} `xml:"temperature"`
+	SupportedGPUTargetTemp struct {
+		GPUTargetTempMin string `xml:"gpu_target_temp_min"`
+		GPUTargetTempMax string `xml:"gpu_target_temp_max"`
+	} `xml:"supported_gpu_target_temp"`
+	PowerReadings struct { // backwards compatibility
+		PowerState         string `xml:"power_state"`
+		PowerManagement    string `xml:"power_management"`
+		PowerDraw          string `xml:"power_draw"`
+		PowerLimit         string `xml:"power_limit"`
+		DefaultPowerLimit  string `xml:"default_power_limit"`
+		EnforcedPowerLimit string `xml:"enforced_power_limit"`
+		MinPowerLimit      string `xml:"min_power_limit"`
+		MaxPowerLimit      string `xml:"max_power_limit"`
+	} `xml:"power_readings"`
+	GPUPowerReadings struct {
+		PowerState          string `xml:"power_state"`
+		PowerDraw           string `xml:"power_draw"`
+		CurrentPowerLimit   string `xml:"current_power_limit"`
+		RequestedPowerLimit string `xml:"requested_power_limit"`
+		DefaultPowerLimit   string `xml:"default_power_limit"`
+		MinPowerLimit       string `xml:"min_power_limit"`
+		MaxPowerLimit       string `xml:"max_power_limit"`
+	} `xml:"gpu_power_readings"`
+	GPUMemoryPowerReadings struct {
+		PowerDraw string `xml:"power_draw"`
+	} `xml:"gpu_memory_power_readings"`
+	ModulePowerReadings struct {
+		PowerState          string `xml:"power_state"`
+		PowerDraw           string `xml:"power_draw"`
+		CurrentPowerLimit   string `xml:"current_power_limit"`
+		RequestedPowerLimit string `xml:"requested_power_limit"`
+		DefaultPowerLimit   string `xml:"default_power_limit"`
+		MinPowerLimit       string `xml:"min_power_limit"`
+		MaxPowerLimit       string `xml:"max_power_limit"`
+	} `xml:"module_power_readings"`
+	Clocks struct {
+		GraphicsClock string `xml:"graphics_clock"`
+		SmClock       string `xml:"sm_clock"`
+		MemClock      string `xml:"mem_clock"`
+		VideoClock    string `xml:"video_clock"`
+	} `xml:"clocks"`
+	MaxClocks struct {
+		GraphicsClock string `xml:"graphics_clock"`
+		SmClock       string `xml:"sm_clock"`
+		MemClock      string `xml:"mem_clock"`
+		VideoClock    string `xml:"video_clock"`
+	} `xml:"max_clocks"`
+	ApplicationsClocks struct {
+		GraphicsClock string `xml:"graphics_clock"`
+		MemClock      string `xml:"mem_clock"`
+	} `xml:"applications_clocks"`
+	DefaultApplicationsClocks struct {
+		GraphicsClock string `xml:"graphics_clock"`
+		MemClock      string `xml:"mem_clock"`
+	} `xml:"default_applications_clocks"`
+	DeferredClocks struct {
+		MemClock string `xml:"mem_clock"`
+	} `xml:"deferred_clocks"`
+	MaxCustomerBoostClocks struct {
+		GraphicsClock string `xml:"graphics_clock"`
+	} `xml:"max_customer_boost_clocks"`
+	SupportedClocks struct {
+		SupportedMemClock []struct {
+			Value                  string   `xml:"value"`
+			SupportedGraphicsClock []string `xml:"supported_graphics_clock"`
+		} `xml:"supported_mem_clock"`
+	} `xml:"supported_clocks"`
+	ClockPolicy struct {
+		AutoBoost        string `xml:"auto_boost"`
+		AutoBoostDefault string `xml:"auto_boost_default"`
+	} `xml:"clock_policy"`
+	Voltage struct {
+		GraphicsVolt string `xml:"graphics_volt"`
+	} `xml:"voltage"`
+	Fabric struct {
+		// one of fabricStates
+		State       string `xml:"state"`
+		Status      string `xml:"status"`
+		CliqueId    string `xml:"cliqueId"`
+		ClusterUuid string `xml:"clusterUuid"`
+		Health      struct {
+			Bandwidth string `xml:"bandwidth"`
+		} `xml:"health"`
+	} `xml:"fabric"`
+	GPUResetStatus struct {
+		ResetRequired            string `xml:"reset_required"`
+		DrainAndResetRecommended string `xml:"drain_and_reset_recommended"`
+	} `xml:"gpu_reset_status"`
+	RetiredPages struct {
+		MultipleSingleBitRetirement struct {
+			RetiredCount string `xml:"retired_count"`
+		} `xml:"multiple_single_bit_retirement"`
+		DoubleBitRetirement struct {
+			RetiredCount string `xml:"retired_count"`
+		} `xml:"double_bit_retirement"`
+		PendingRetirement string `xml:"pending_retirement"`
+	} `xml:"retired_pages"`
+	RemappedRows struct {
+		Correctable   string `xml:"remapped_row_corr"`
+		Uncorrectable string `xml:"remapped_row_unc"`
+		Pending       string `xml:"remapped_row_pending"`
+		Failure       string `xml:"remapped_row_failure"`
+	} `xml:"remapped_rows"`
+	Processes struct {
+		ProcessInfo []struct {
+			Pid         int64  `xml:"pid"`
+			Type        string `xml:"type"`
+			ProcessName string `xml:"process_name"`
+			UsedMemory  string `xml:"used_memory"`
+		} `xml:"process_info"`
+	} `xml:"processes"`
+}
 
+// Execute nvidia-smi with given args, or read its recorded output in test mode.
+// In test mode without a recorded file for this command, returns nil output.
+func runNvidiaSmi(ctx context.Context, recordedFile string, args ...string) ([]byte, error) {
+	if recordedFile != "" {
+		return ioutil.ReadFile(recordedFile)
+	}
 	if *testFile != "" {
-		// read test file
-		stdout, err = ioutil.ReadFile(*testFile)
-	} else {
-		// execute system command
-		cmd := exec.Command(*nvidiaSmiPath, "-q", "-x")
-		stdout, err = cmd.Output()
+		return nil, nil
 	}
+	cmd := exec.CommandContext(ctx, currentConfig().Sources.NvidiaSmiPath, args...)
+	return cmd.Output()
+}
+
+// fabric registration states, others are reported as "Unknown"
+var fabricStates = []string{"Not Started", "In Progress", "Completed", "Unknown"}
+
+// clock throttle (event) reasons by name without prefix (gpu_idle, sw_power_cap...)
+type ClockReasons map[string]string
+
+var clockReasonNames = []string{
+	"gpu_idle",
+	"applications_clocks_setting",
+	"sw_power_cap",
+	"hw_slowdown",
+	"hw_thermal_slowdown",
+	"hw_power_brake_slowdown",
+	"sync_boost",
+	"sw_thermal_slowdown",
+	"display_clocks_setting",
+}
+
+func (gpu NvidiaSmiGpu) clockReasons() ClockReasons {
+	if gpu.ClockThrottleReasons == nil {
+		// renamed to clocks_event_reasons in newer drivers
+		return gpu.ClockEventReasons
+	}
+	return gpu.ClockThrottleReasons
+}
+
+func (r *ClockReasons) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var t struct {
+		Items []struct {
+			XMLName xml.Name
+			Value   string `xml:",chardata"`
+		} `xml:",any"`
+	}
+	if err := d.DecodeElement(&t, &start); err != nil {
+		return err
+	}
+	*r = make(ClockReasons)
+	for _, item := range t.Items {
+		name := strings.TrimPrefix(item.XMLName.Local, "clocks_throttle_reason_")
+		name = strings.TrimPrefix(name, "clocks_event_reason_")
+		(*r)[name] = strings.TrimSpace(item.Value)
+	}
+	return nil
+}
+
+func readNvidiaSmiOutput(ctx context.Context) (NvidiaSmiOutput, error) {
+	var t NvidiaSmiOutput
+
+	stdout, err := runNvidiaSmi(ctx, *testFile, "-q", "-x")
 	if err != nil {
 		return t, err
 	}
@@ -226,53 +344,125 @@ func filterVersion(value string) string {
 	return version
 }
 
-func filterUnit(s string) string {
-	r := regexp.MustCompile(`(?P<value>[\d\.]+) (?P<power>[KMGT]?[i]?)(?P<unit>.*)`)
-	match := r.FindStringSubmatch(s)
-	if len(match) == 0 {
-		return "0"
+// State of a field value in nvidia-smi output. Anything but ValueOk means there is no reading.
+type ValueState int
+
+const (
+	ValueOk           ValueState = iota
+	ValueAbsent                  // field is not present in this nvidia-smi version
+	ValueNotSupported            // [Not Supported]
+	ValueNotAvailable            // N/A
+	ValueError                   // [Unknown Error], [GPU requires reset] or unparsable value
+)
+
+func (s ValueState) String() string {
+	switch s {
+	case ValueOk:
+		return "ok"
+	case ValueAbsent:
+		return "absent"
+	case ValueNotSupported:
+		return "not_supported"
+	case ValueNotAvailable:
+		return "not_available"
 	}
+	return "error"
+}
 
-	result := make(map[string]string)
-	for i, name := range r.SubexpNames() {
-		if i != 0 && name != "" {
-			result[name] = match[i]
-		}
+type Value struct {
+	Value float64
+	State ValueState
+}
+
+func (v Value) String() string {
+	return fmt.Sprintf("%g", v.Value)
+}
+
+func fieldState(s string) ValueState {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "":
+		return ValueAbsent
+	case s == "N/A":
+		return ValueNotAvailable
+	case s == "Not Supported" || s == "[Not Supported]":
+		return ValueNotSupported
+	case strings.HasPrefix(s, "["):
+		return ValueError
 	}
+	return ValueOk
+}
 
-	power := result["power"]
-	if value, err := strconv.ParseFloat(result["value"], 32); err == nil {
-		switch power {
-		case "K":
-			value *= 1000
-		case "M":
-			value *= 1000 * 1000
-		case "G":
-			value *= 1000 * 1000 * 1000
-		case "T":
-			value *= 1000 * 1000 * 1000 * 1000
-		case "Ki":
-			value *= 1024
-		case "Mi":
-			value *= 1024 * 1024
-		case "Gi":
-			value *= 1024 * 1024 * 1024
-		case "Ti":
-			value *= 1024 * 1024 * 1024 * 1024
-		}
-		return fmt.Sprintf("%g", value)
+// "449.27 W", "24564 MiB", "1045.000 mV", "-7 C"
+func parseUnit(s string) Value {
+	if state := fieldState(s); state != ValueOk {
+		return Value{State: state}
 	}
-	return "0"
+	r := regexp.MustCompile(`^\s*(-?[\d\.]+)\s*([KMGTm]?i?)`)
+	match := r.FindStringSubmatch(s)
+	if match == nil {
+		return Value{State: ValueError}
+	}
+	value, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return Value{State: ValueError}
+	}
+	switch match[2] {
+	case "m":
+		value /= 1000
+	case "K":
+		value *= 1000
+	case "M":
+		value *= 1000 * 1000
+	case "G":
+		value *= 1000 * 1000 * 1000
+	case "T":
+		value *= 1000 * 1000 * 1000 * 1000
+	case "Ki":
+		value *= 1024
+	case "Mi":
+		value *= 1024 * 1024
+	case "Gi":
+		value *= 1024 * 1024 * 1024
+	case "Ti":
+		value *= 1024 * 1024 * 1024 * 1024
+	}
+	return Value{Value: value}
+}
+
+// "P2", "16x", "0"
+func parseNumber(s string) Value {
+	if state := fieldState(s); state != ValueOk {
+		return Value{State: state}
+	}
+	value, err := strconv.ParseFloat(regexp.MustCompile("[^0-9.-]").ReplaceAllString(s, ""), 64)
+	if err != nil {
+		return Value{State: ValueError}
+	}
+	return Value{Value: value}
 }
 
-func filterNumber(value string) string {
-	r := regexp.MustCompile("[^0-9.]")
-	return r.ReplaceAllString(value, "")
+// "Active" / "Not Active"
+func parseActive(s string) Value {
+	if state := fieldState(s); state != ValueOk {
+		return Value{State: state}
+	}
+	if s == "Active" {
+		return Value{Value: 1}
+	}
+	return Value{Value: 0}
 }
 
-func filterActive(value string) string {
-	if value == "Active" {
-		return "1"
+// "Enabled" / "Disabled", "On" / "Off", "Yes" / "No"
+func parseEnabled(s string) Value {
+	if state := fieldState(s); state != ValueOk {
+		return Value{State: state}
+	}
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "enabled", "on", "yes":
+		return Value{Value: 1}
+	case "disabled", "off", "no":
+		return Value{Value: 0}
 	}
-	return "0"
+	return Value{State: ValueError}
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFieldState(t *testing.T) {
+	tests := []struct {
+		in   string
+		want ValueState
+	}{
+		{"", ValueAbsent},
+		{"  ", ValueAbsent},
+		{"N/A", ValueNotAvailable},
+		{" N/A ", ValueNotAvailable},
+		{"[Not Supported]", ValueNotSupported},
+		{"Not Supported", ValueNotSupported},
+		{"[Unknown Error]", ValueError},
+		{"[GPU requires reset]", ValueError},
+		{"[Insufficient Permissions]", ValueError},
+		{"24564 MiB", ValueOk},
+		{"Active", ValueOk},
+	}
+	for _, tt := range tests {
+		if got := fieldState(tt.in); got != tt.want {
+			t.Errorf("fieldState(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseUnit(t *testing.T) {
+	tests := []struct {
+		in    string
+		value float64
+		state ValueState
+	}{
+		{"449.27 W", 449.27, ValueOk},
+		{"24564 MiB", 24564 * 1024 * 1024, ValueOk},
+		{"24 GiB", 24 * 1024 * 1024 * 1024, ValueOk},
+		{"81234569 KiB", 81234569 * 1024, ValueOk},
+		{"1045.000 mV", 1.045, ValueOk},
+		{"2500 mW", 2.5, ValueOk},
+		{"-7 C", -7, ValueOk},
+		{"-0.5 W", -0.5, ValueOk},
+		{"32 C", 32, ValueOk},
+		{"45 %", 45, ValueOk},
+		{"14.062 GB/s", 14.062e9, ValueOk},
+		// M and m are read as SI prefixes of any unit: megahertz and milliseconds come out
+		// in Hz and seconds, which is what the metrics using them expect
+		{"1395 MHz", 1395e6, ValueOk},
+		{"100 ms", 0.1, ValueOk},
+		{"3 KB", 3000, ValueOk},
+		{"N/A", 0, ValueNotAvailable},
+		{"[Not Supported]", 0, ValueNotSupported},
+		{"[Unknown Error]", 0, ValueError},
+		{"[GPU requires reset]", 0, ValueError},
+		{"", 0, ValueAbsent},
+		{"Enabled", 0, ValueError},
+		{"W", 0, ValueError},
+		{"1.2.3 W", 0, ValueError},
+	}
+	for _, tt := range tests {
+		got := parseUnit(tt.in)
+		if got.State != tt.state || got.Value != tt.value {
+			t.Errorf("parseUnit(%q) = %+v, want {Value:%g State:%v}", tt.in, got, tt.value, tt.state)
+		}
+	}
+}
+
+func TestParseNumber(t *testing.T) {
+	tests := []struct {
+		in    string
+		value float64
+		state ValueState
+	}{
+		{"P2", 2, ValueOk},
+		{"16x", 16, ValueOk},
+		{"0", 0, ValueOk},
+		{"-3", -3, ValueOk},
+		{"N/A", 0, ValueNotAvailable},
+		{"[Unknown Error]", 0, ValueError},
+		{"Default", 0, ValueError},
+	}
+	for _, tt := range tests {
+		got := parseNumber(tt.in)
+		if got.State != tt.state || got.Value != tt.value {
+			t.Errorf("parseNumber(%q) = %+v, want {Value:%g State:%v}", tt.in, got, tt.value, tt.state)
+		}
+	}
+}
+
+func TestParseEnabledActive(t *testing.T) {
+	tests := []struct {
+		fn    func(string) Value
+		in    string
+		value float64
+		state ValueState
+	}{
+		{parseEnabled, "Enabled", 1, ValueOk},
+		{parseEnabled, "On", 1, ValueOk},
+		{parseEnabled, "Yes", 1, ValueOk},
+		{parseEnabled, "Disabled", 0, ValueOk},
+		{parseEnabled, "Off", 0, ValueOk},
+		{parseEnabled, "no", 0, ValueOk},
+		{parseEnabled, "N/A", 0, ValueNotAvailable},
+		{parseEnabled, "[Not Supported]", 0, ValueNotSupported},
+		{parseEnabled, "Pending", 0, ValueError},
+		{parseActive, "Active", 1, ValueOk},
+		{parseActive, "Not Active", 0, ValueOk},
+		{parseActive, "[Unknown Error]", 0, ValueError},
+	}
+	for _, tt := range tests {
+		got := tt.fn(tt.in)
+		if got.State != tt.state || got.Value != tt.value {
+			t.Errorf("%q = %+v, want {Value:%g State:%v}", tt.in, got, tt.value, tt.state)
+		}
+	}
+}
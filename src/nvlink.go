@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type NvLink struct {
+	Active bool
+	Speed  string            // "14.062 GB/s"
+	Errors map[string]string // by error type (replay, recovery, crc)
+	DataTx string            // "81234569 KiB" since driver load
+	DataRx string
+}
+
+type NvLinkInfo map[string]map[int]*NvLink // by GPU UUID and link number
+
+// Parse `nvidia-smi nvlink` output:
+//
+//	GPU 0: NVIDIA GeForce RTX 3090 (UUID: GPU-...)
+//		 Link 0: 14.062 GB/s
+//
+// calling fn for each link line with the text after "Link N: "
+func parseNvLinkOutput(data []byte, fn func(uuid string, link int, value string)) error {
+	gpuRe := regexp.MustCompile(`^GPU \d+: .*\(UUID: (GPU-[0-9a-fA-F-]+)\)`)
+	linkRe := regexp.MustCompile(`^\s*Link (\d+): (.+)$`)
+	uuid := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		if m := gpuRe.FindStringSubmatch(line); m != nil {
+			uuid = m[1]
+		} else if m := linkRe.FindStringSubmatch(line); m != nil {
+			if uuid == "" {
+				return fmt.Errorf("link info before GPU header: %q", line)
+			}
+			link, _ := strconv.Atoi(m[1])
+			fn(uuid, link, strings.TrimSpace(m[2]))
+		}
+	}
+	return nil
+}
+
+func readNvLinkInfo(ctx context.Context) (NvLinkInfo, error) {
+	result := make(NvLinkInfo)
+	get := func(uuid string, link int) *NvLink {
+		if result[uuid] == nil {
+			result[uuid] = make(map[int]*NvLink)
+		}
+		if result[uuid][link] == nil {
+			result[uuid][link] = &NvLink{Errors: make(map[string]string)}
+		}
+		return result[uuid][link]
+	}
+
+	// link state and speed
+	stdout, err := runNvidiaSmi(ctx, *testNvLinkStatusFile, "nvlink", "-s")
+	if err != nil {
+		return nil, fmt.Errorf("nvidia-smi nvlink -s: %v", err)
+	}
+	err = parseNvLinkOutput(stdout, func(uuid string, link int, value string) {
+		l := get(uuid, link)
+		l.Active = !strings.Contains(value, "inactive")
+		if l.Active {
+			l.Speed = value
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error parsing nvidia-smi nvlink -s output: %v", err)
+	}
+
+	// error counters: "Replay Errors: 0"
+	stdout, err = runNvidiaSmi(ctx, *testNvLinkErrorsFile, "nvlink", "-e")
+	if err != nil {
+		return nil, fmt.Errorf("nvidia-smi nvlink -e: %v", err)
+	}
+	err = parseNvLinkOutput(stdout, func(uuid string, link int, value string) {
+		kv := strings.SplitN(value, ":", 2)
+		if len(kv) == 2 {
+			name := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(kv[0]), " Errors"))
+			get(uuid, link).Errors[strings.ReplaceAll(name, " ", "_")] = strings.TrimSpace(kv[1])
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error parsing nvidia-smi nvlink -e output: %v", err)
+	}
+
+	// data throughput counters: "Data Tx: 81234569 KiB"
+	stdout, err = runNvidiaSmi(ctx, *testNvLinkThroughputFile, "nvlink", "-gt", "d")
+	if err != nil {
+		return nil, fmt.Errorf("nvidia-smi nvlink -gt d: %v", err)
+	}
+	err = parseNvLinkOutput(stdout, func(uuid string, link int, value string) {
+		kv := strings.SplitN(value, ":", 2)
+		if len(kv) == 2 {
+			switch strings.TrimSpace(kv[0]) {
+			case "Data Tx":
+				get(uuid, link).DataTx = strings.TrimSpace(kv[1])
+			case "Data Rx":
+				get(uuid, link).DataRx = strings.TrimSpace(kv[1])
+			}
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error parsing nvidia-smi nvlink -gt output: %v", err)
+	}
+
+	return result, nil
+}
+
+func init() {
+	registerCollector("nvlink", false, "NVLink status, error and throughput counters from `nvidia-smi nvlink`", "nvlink_.*", &nvLinkCollector{})
+}
+
+type nvLinkCollector struct{}
+
+func (c *nvLinkCollector) Update(ctx context.Context, core *OutputData) (func(*OutputData), error) {
+	info, err := readNvLinkInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return func(data *OutputData) {
+		data.nvLinkInfo = info
+	}, nil
+}
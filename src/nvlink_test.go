@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestReadNvLinkInfo(t *testing.T) {
+	*testNvLinkStatusFile = "../test-files/nvlink-status-4-geforce-rtx-3090.txt"
+	*testNvLinkErrorsFile = "../test-files/nvlink-errors-4-geforce-rtx-3090.txt"
+	*testNvLinkThroughputFile = "../test-files/nvlink-throughput-4-geforce-rtx-3090.txt"
+	defer func() {
+		*testNvLinkStatusFile, *testNvLinkErrorsFile, *testNvLinkThroughputFile = "", "", ""
+	}()
+
+	info, err := readNvLinkInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info) != 4 {
+		t.Fatalf("got %d GPUs, want 4", len(info))
+	}
+
+	tests := []struct {
+		uuid   string
+		link   int
+		active bool
+		speed  string
+		tx, rx string
+		errors map[string]string
+	}{
+		{
+			uuid:   "GPU-8ad6666a-677c-9f0e-3b58-90220b309ddc",
+			link:   0,
+			active: false,
+		},
+		{
+			uuid:   "GPU-0a66778f-a4ed-a1ff-a65e-98882252dca3",
+			link:   0,
+			active: true,
+			speed:  "14.062 GB/s",
+			tx:     "81234569 KiB",
+			rx:     "79876545 KiB",
+			errors: map[string]string{"replay": "0", "recovery": "0", "crc": "0"},
+		},
+		{
+			uuid:   "GPU-4354b5f6-0a4f-36ce-970f-054bc842cb90",
+			link:   3,
+			active: true,
+			speed:  "14.062 GB/s",
+			tx:     "81237570 KiB",
+			rx:     "79879546 KiB",
+			errors: map[string]string{"replay": "0", "recovery": "0", "crc": "0"},
+		},
+	}
+	for _, tt := range tests {
+		link, ok := info[tt.uuid][tt.link]
+		if !ok {
+			t.Errorf("%s link %d: missing", tt.uuid, tt.link)
+			continue
+		}
+		if link.Active != tt.active || link.Speed != tt.speed {
+			t.Errorf("%s link %d: active %v speed %q, want %v %q", tt.uuid, tt.link, link.Active, link.Speed, tt.active, tt.speed)
+		}
+		if link.DataTx != tt.tx || link.DataRx != tt.rx {
+			t.Errorf("%s link %d: tx %q rx %q, want %q %q", tt.uuid, tt.link, link.DataTx, link.DataRx, tt.tx, tt.rx)
+		}
+		for name, value := range tt.errors {
+			if link.Errors[name] != value {
+				t.Errorf("%s link %d: %s errors %q, want %q", tt.uuid, tt.link, name, link.Errors[name], value)
+			}
+		}
+	}
+
+	// parsed values as exported
+	if v := parseUnit(info["GPU-0a66778f-a4ed-a1ff-a65e-98882252dca3"][0].Speed); v.State != ValueOk || v.Value != 14.062e9 {
+		t.Errorf("speed parsed as %+v, want 14.062e9", v)
+	}
+	if v := parseUnit(info["GPU-0a66778f-a4ed-a1ff-a65e-98882252dca3"][0].DataTx); v.State != ValueOk || v.Value != 81234569*1024 {
+		t.Errorf("tx parsed as %+v, want %d", v, 81234569*1024)
+	}
+}
+
+func TestParseNvLinkOutputLinkBeforeGpu(t *testing.T) {
+	err := parseNvLinkOutput([]byte("\t Link 0: 14.062 GB/s\n"), func(string, int, string) {})
+	if err == nil {
+		t.Error("expected an error for a link line before the GPU header")
+	}
+}
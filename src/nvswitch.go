@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+)
+
+type NvSwitchInfo struct {
+	Id     string // sysfs PCI Id
+	Vendor VendorInfo
+	Aer    AerInfo
+}
+
+// NVSwitches are PCI bridges (class 0x0680) made by NVIDIA
+func findNvSwitches() []string {
+	dirs, err := ioutil.ReadDir("/sys/bus/pci/devices")
+	if err != nil {
+		return nil
+	}
+	var result []string
+	for _, dir := range dirs {
+		path := "/sys/bus/pci/devices/" + dir.Name() + "/"
+		if readSysfsId(path+"vendor") == "10de" && strings.HasPrefix(readSysfsId(path+"class"), "0680") {
+			result = append(result, dir.Name())
+		}
+	}
+	return result
+}
+
+func readNvSwitchInfo() []NvSwitchInfo {
+	var result []NvSwitchInfo
+	for _, id := range findNvSwitches() {
+		result = append(result, NvSwitchInfo{
+			Id:     id,
+			Vendor: vendorInfo(id, "", ""),
+			Aer:    aerInfo(id),
+		})
+	}
+	return result
+}
+
+// states reported by `systemctl is-active`, others are reported as "unknown"
+var fabricManagerStates = []string{"active", "activating", "deactivating", "failed", "inactive", "reloading", "unknown"}
+
+// state of nvidia-fabricmanager service, one of fabricManagerStates
+func fabricManagerState(ctx context.Context) string {
+	var out []byte
+	if *testFabricManagerFile != "" {
+		out, _ = ioutil.ReadFile(*testFabricManagerFile)
+	} else if *testFile == "" {
+		cmd := exec.CommandContext(ctx, "systemctl", "is-active", "nvidia-fabricmanager")
+		// is-active exits with non-zero code if not active, but still prints the state
+		out, _ = cmd.Output()
+	}
+	state := strings.TrimSpace(string(out))
+	for _, known := range fabricManagerStates {
+		if state == known {
+			return state
+		}
+	}
+	return "unknown"
+}
+
+func init() {
+	registerCollector("nvswitch", false, "NVSwitch AER counters and nvidia-fabricmanager state (HGX systems)", "nvswitch_.*|fabric_manager_.*", &nvSwitchCollector{})
+}
+
+type nvSwitchCollector struct{}
+
+func (c *nvSwitchCollector) Update(ctx context.Context, core *OutputData) (func(*OutputData), error) {
+	switches := readNvSwitchInfo()
+	state := fabricManagerState(ctx)
+	return func(data *OutputData) {
+		data.nvSwitchInfo = switches
+		data.fabricManager = state
+	}, nil
+}
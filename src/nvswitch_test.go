@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFabricManagerState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nvswitch_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { *testFile, *testFabricManagerFile = "", "" }()
+
+	// systemctl is not run in test mode
+	*testFile = "../test-files/4-geforce-rtx-3090.xml"
+	if state := fabricManagerState(context.Background()); state != "unknown" {
+		t.Errorf("test mode without file: %q, want unknown", state)
+	}
+
+	tests := map[string]string{
+		"active\n":    "active",
+		"failed\n":    "failed",
+		"inactive":    "inactive",
+		"maintenance": "unknown",
+		"":            "unknown",
+	}
+	for out, want := range tests {
+		*testFabricManagerFile = writeTestFile(t, dir, "state.txt", out)
+		if state := fabricManagerState(context.Background()); state != want {
+			t.Errorf("%q: %q, want %q", out, state, want)
+		}
+	}
+}
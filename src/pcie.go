@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
-	"os/exec"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -10,12 +12,44 @@ import (
 	"github.com/prometheus/common/log"
 )
 
-type AerInfo struct {
-	AerFatalCount       int
-	AerNonFatalCount    int
-	AerCorrectableCount int
+// aer counters of one severity, as read from aer_dev_* in sysfs
+type AerCounters struct {
+	Total  int
+	Errors map[string]int // by error type (RxErr, BadTLP, CmpltTO...)
 }
 
+// by aer type (fatal, non-fatal, correctable), types with unreadable counters are omitted
+type AerInfo map[string]AerCounters
+
+var aerTypes = []struct {
+	name  string
+	file  string
+	total string
+}{
+	{"fatal", "aer_dev_fatal", "TOTAL_ERR_FATAL"},
+	{"non-fatal", "aer_dev_nonfatal", "TOTAL_ERR_NONFATAL"},
+	{"correctable", "aer_dev_correctable", "TOTAL_ERR_COR"},
+}
+
+// link state as seen by one end of the link
+type PciLinkInfo struct {
+	CurrentSpeed float64 // GT/s
+	MaxSpeed     float64
+	CurrentWidth int
+	MaxWidth     int
+	PortType     int // PCIe device/port type from config space, -1 if not readable
+}
+
+// PCIe device/port types
+const (
+	pciePortEndpoint         = 0x0
+	pciePortLegacyEndpoint   = 0x1
+	pciePortRootPort         = 0x4
+	pciePortSwitchUpstream   = 0x5
+	pciePortSwitchDownstream = 0x6
+	pciePortPcieToPciBridge  = 0x7
+)
+
 type VendorInfo struct {
 	Vendor       string
 	Device       string
@@ -23,61 +57,313 @@ type VendorInfo struct {
 	SubsysDevice string
 }
 
-func aerInfo(id string) AerInfo {
-	result := AerInfo{-1, -1, -1}
+// domains above ffff are used behind Intel VMD
+var pciIdRegexp = regexp.MustCompile(`^[0-9a-f]{4,}:[0-9a-f]{2}:[0-9a-f]{2}\.[0-7]$`)
+
+// convert nvidia-smi bus id (00000000:01:00.0) to sysfs form (0000:01:00.0)
+func sysfsPciId(id string) string {
+	return strings.ToLower(regexp.MustCompile(`^0000([0-9A-Fa-f]{4}:)`).ReplaceAllString(id, "$1"))
+}
+
+func sysfsPciPath(id string) string {
+	return "/sys/bus/pci/devices/" + sysfsPciId(id) + "/"
+}
 
-	path := "/sys/bus/pci/devices/" +
-		strings.ToLower(regexp.MustCompile(`^0000(\d{4})`).ReplaceAllString(id, "$1")) + "/"
+// short form used in labels: 00000000:01:00.0 or 0000:01:00.0 -> 01:00.0
+func shortPciId(id string) string {
+	return strings.ToUpper(regexp.MustCompile(`^(0{8}|0{4}):`).ReplaceAllString(id, ""))
+}
 
-	t, err := ioutil.ReadFile(path + "aer_dev_fatal")
-	if err == nil {
-		result.AerFatalCount, _ = strconv.Atoi(string(regexp.MustCompile(`TOTAL_ERR_FATAL (\d+)`).FindSubmatch(t)[1]))
+// bridges between the device and the root complex, nearest first (root port is the last one)
+func pciUpstreamBridges(id string) []string {
+	path, err := filepath.EvalSymlinks(sysfsPciPath(id))
+	if err != nil {
+		return nil
 	}
+	return pciBridgesInPath(path)
+}
 
-	t, err = ioutil.ReadFile(path + "aer_dev_nonfatal")
-	if err == nil {
-		result.AerNonFatalCount, _ = strconv.Atoi(string(regexp.MustCompile(`TOTAL_ERR_NONFATAL (\d+)`).FindSubmatch(t)[1]))
+// path is the resolved sysfs path of the device, e.g. /sys/devices/pci0000:00/0000:00:01.0/0000:01:00.0
+func pciBridgesInPath(path string) []string {
+	var result []string
+	for {
+		path = filepath.Dir(path)
+		name := filepath.Base(path)
+		if !pciIdRegexp.MatchString(name) {
+			break
+		}
+		result = append(result, name)
 	}
+	return result
+}
 
-	t, err = ioutil.ReadFile(path + "aer_dev_correctable")
-	if err == nil {
-		result.AerCorrectableCount, _ = strconv.Atoi(string(regexp.MustCompile(`TOTAL_ERR_COR (\d+)`).FindSubmatch(t)[1]))
+func parseAerCounters(data []byte, totalName string) (AerCounters, error) {
+	result := AerCounters{Errors: make(map[string]int)}
+	hasTotal := false
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		n, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		if fields[0] == totalName {
+			result.Total = n
+			hasTotal = true
+		} else {
+			result.Errors[fields[0]] = n
+		}
 	}
+	if !hasTotal {
+		if len(result.Errors) == 0 {
+			return result, fmt.Errorf("no %s counters found", totalName)
+		}
+		// older kernels do not print the total line
+		for _, n := range result.Errors {
+			result.Total += n
+		}
+	}
+	return result, nil
+}
 
+func aerInfo(id string) AerInfo {
+	result := make(AerInfo)
+	path := sysfsPciPath(id)
+	for _, t := range aerTypes {
+		data, err := ioutil.ReadFile(path + t.file)
+		if err != nil {
+			// no aer support on this device or kernel
+			continue
+		}
+		counters, err := parseAerCounters(data, t.total)
+		if err != nil {
+			log.Errorln("AER:", path+t.file+":", err)
+			continue
+		}
+		result[t.name] = counters
+	}
 	return result
 }
 
-func initVendorInfo() {
-	cmd := exec.Command("/usr/sbin/update-pciids")
-	_, err := cmd.Output()
+func readSysfsFloat(path string) (float64, error) {
+	t, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Errorln(err)
+		return 0, err
+	}
+	// "16.0 GT/s PCIe", "8 GT/s", "16"
+	m := regexp.MustCompile(`^\s*([\d.]+)`).FindStringSubmatch(string(t))
+	if m == nil {
+		return 0, fmt.Errorf("%s: unexpected value %q", path, strings.TrimSpace(string(t)))
 	}
+	return strconv.ParseFloat(m[1], 64)
 }
 
-func vendorInfo(id string) VendorInfo {
-	result := VendorInfo{}
-	cmd := exec.Command("/usr/bin/lspci", "-vmm", "-s", id)
-	out, err := cmd.Output()
+// PCIe device/port type from the PCI Express capability, -1 if config space beyond the
+// header is not readable (without CAP_SYS_ADMIN) or the device has no such capability
+func pciePortType(config []byte) int {
+	if len(config) < 0x40 {
+		return -1
+	}
+	// capability list, bounded in case it loops
+	ptr := int(config[0x34] &^ 3)
+	for i := 0; i < 48 && ptr >= 0x40 && ptr+3 < len(config); i++ {
+		if config[ptr] == 0x10 {
+			return int(config[ptr+2] >> 4)
+		}
+		ptr = int(config[ptr+1] &^ 3)
+	}
+	return -1
+}
+
+func pciLinkInfo(id string) (PciLinkInfo, bool) {
+	result := PciLinkInfo{PortType: -1}
+	path := sysfsPciPath(id)
+	if config, err := ioutil.ReadFile(path + "config"); err == nil {
+		result.PortType = pciePortType(config)
+	}
+
+	var err error
+	if result.CurrentSpeed, err = readSysfsFloat(path + "current_link_speed"); err != nil {
+		return result, false
+	}
+	if result.MaxSpeed, err = readSysfsFloat(path + "max_link_speed"); err != nil {
+		return result, false
+	}
+	width, err := readSysfsFloat(path + "current_link_width")
 	if err != nil {
-		return result
-	}
-	re := regexp.MustCompile(`^([A-Za-z]+):\s+(.+)$`)
-	for _, line := range strings.Split(string(out), "\n") {
-		m := re.FindStringSubmatch(line)
-		if len(m) >= 3 {
-			k := m[1]
-			v := m[2]
-			if k == "Vendor" {
-				result.Vendor = v
-			} else if k == "Device" {
-				result.Device = v
-			} else if k == "SVendor" {
-				result.SubsysVendor = v
-			} else if k == "SDevice" {
-				result.SubsysDevice = v
+		return result, false
+	}
+	result.CurrentWidth = int(width)
+	if width, err = readSysfsFloat(path + "max_link_width"); err != nil {
+		return result, false
+	}
+	result.MaxWidth = int(width)
+	return result, true
+}
+
+// Physical links on the path from the GPU to the root complex (nearest first), as pairs of
+// the downstream end and its parent. Only endpoints, switch upstream ports and PCIe-to-PCI
+// bridges have a link to their parent, link state of switch downstream ports and root ports
+// is that of the link below them. Without port types, switch ports are assumed to alternate:
+// GPU, [switch downstream port, switch upstream port]..., root port.
+func pciLinks(path []string, links map[string]PciLinkInfo) [][2]string {
+	typed := true
+	for _, id := range path {
+		if link, ok := links[id]; ok && link.PortType < 0 {
+			typed = false
+		}
+	}
+	var result [][2]string
+	for i := 0; i+1 < len(path); i++ {
+		link, ok := links[path[i]]
+		if !ok {
+			continue
+		}
+		if typed {
+			switch link.PortType {
+			case pciePortEndpoint, pciePortLegacyEndpoint, pciePortSwitchUpstream, pciePortPcieToPciBridge:
+			default:
+				continue
 			}
+		} else if i%2 != 0 {
+			continue
+		}
+		result = append(result, [2]string{path[i], path[i+1]})
+	}
+	return result
+}
+
+// A link is described by its downstream end and limited by the capabilities of both ends.
+func pciLinkDegraded(child, parent PciLinkInfo) bool {
+	expectedSpeed := child.MaxSpeed
+	if parent.MaxSpeed > 0 && parent.MaxSpeed < expectedSpeed {
+		expectedSpeed = parent.MaxSpeed
+	}
+	expectedWidth := child.MaxWidth
+	if parent.MaxWidth > 0 && parent.MaxWidth < expectedWidth {
+		expectedWidth = parent.MaxWidth
+	}
+	return child.CurrentSpeed < expectedSpeed || child.CurrentWidth < expectedWidth
+}
+
+func readSysfsId(path string) string {
+	t, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(string(t))), "0x")
+}
+
+// deviceId and subSystemId are nvidia-smi's pci_device_id/pci_sub_system_id (268410DE or 0x268410DE),
+// used when sysfs is not available (e.g. in test mode)
+func vendorInfo(id string, deviceId string, subSystemId string) VendorInfo {
+	path := sysfsPciPath(id)
+	vendor := readSysfsId(path + "vendor")
+	device := readSysfsId(path + "device")
+	subVendor := readSysfsId(path + "subsystem_vendor")
+	subDevice := readSysfsId(path + "subsystem_device")
+	if vendor == "" || device == "" {
+		// current versions print them with 0x prefix
+		normalize := func(id string) string {
+			return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(id)), "0x")
+		}
+		re := regexp.MustCompile(`^([0-9a-f]{4})([0-9a-f]{4})$`)
+		m := re.FindStringSubmatch(normalize(deviceId))
+		if m == nil {
+			return VendorInfo{}
 		}
+		device, vendor = m[1], m[2]
+		if m := re.FindStringSubmatch(normalize(subSystemId)); m != nil {
+			subDevice, subVendor = m[1], m[2]
+		}
+	}
+
+	pciIds := currentPciIds()
+	result := VendorInfo{
+		Vendor: pciIds.vendorName(vendor),
+		Device: pciIds.deviceName(vendor, device),
+	}
+	if subVendor != "" && subDevice != "" {
+		result.SubsysVendor = pciIds.vendorName(subVendor)
+		result.SubsysDevice = pciIds.subsystemName(vendor, device, subVendor, subDevice)
 	}
 	return result
 }
+
+func init() {
+	registerCollector("aer", true, "PCIe AER counters of GPUs and upstream bridges from sysfs", "(bridge_)?aer_.*", &aerCollector{})
+	registerCollector("pcie_link", true, "PCIe link speed/width of GPUs and upstream bridges from sysfs", "pcie_link_.*", &pcieLinkCollector{})
+	registerCollector("pci_info", true, "PCI vendor/device names and NUMA/IOMMU placement from sysfs", "numa_node|topology_info|pci_bridge_info", &pciInfoCollector{})
+}
+
+type aerCollector struct{}
+
+func (c *aerCollector) Update(ctx context.Context, core *OutputData) (func(*OutputData), error) {
+	gpuAer := make(map[string]AerInfo)
+	bridgeAer := make(map[string]AerInfo)
+	for _, gpu := range core.nvidiaSmiOutput.GPU {
+		gpuAer[gpu.Id] = aerInfo(gpu.Id)
+		for _, bridge := range core.pciBridges[gpu.Id] {
+			if _, ok := bridgeAer[bridge]; !ok {
+				bridgeAer[bridge] = aerInfo(bridge)
+			}
+		}
+	}
+	return func(data *OutputData) {
+		data.aerInfo = gpuAer
+		data.bridgeAerInfo = bridgeAer
+	}, nil
+}
+
+type pcieLinkCollector struct{}
+
+func (c *pcieLinkCollector) Update(ctx context.Context, core *OutputData) (func(*OutputData), error) {
+	links := make(map[string]PciLinkInfo)
+	for _, gpu := range core.nvidiaSmiOutput.GPU {
+		for _, id := range append([]string{gpu.Id}, core.pciBridges[gpu.Id]...) {
+			if _, ok := links[id]; ok {
+				continue
+			}
+			if link, ok := pciLinkInfo(id); ok {
+				links[id] = link
+			}
+		}
+	}
+	return func(data *OutputData) {
+		data.linkInfo = links
+	}, nil
+}
+
+// names and placement do not change, so they are only read for new (or hot-added) GPUs,
+// and names again when another pci.ids file is loaded
+type pciInfoCollector struct {
+	vendorInfo       map[string]VendorInfo
+	pciTopology      map[string]PciTopology
+	pciIdsGeneration int
+}
+
+func (c *pciInfoCollector) Update(ctx context.Context, core *OutputData) (func(*OutputData), error) {
+	if _, generation := currentPciIdsGeneration(); generation != c.pciIdsGeneration {
+		c.vendorInfo = nil
+		c.pciIdsGeneration = generation
+	}
+	vendors := make(map[string]VendorInfo)
+	topology := make(map[string]PciTopology)
+	for _, gpu := range core.nvidiaSmiOutput.GPU {
+		if vendor, ok := c.vendorInfo[gpu.Id]; ok {
+			vendors[gpu.Id] = vendor
+			topology[gpu.Id] = c.pciTopology[gpu.Id]
+		} else {
+			vendors[gpu.Id] = vendorInfo(gpu.Id, gpu.PCI.DeviceId, gpu.PCI.SubSystemId)
+			topology[gpu.Id] = pciTopology(gpu.Id, core.pciBridges[gpu.Id])
+		}
+	}
+	c.vendorInfo = vendors
+	c.pciTopology = topology
+	return func(data *OutputData) {
+		data.vendorInfo = vendors
+		data.pciTopology = topology
+	}, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAerCounters(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		total int
+		errs  map[string]int
+		ok    bool
+	}{
+		{"with total", "RxErr 1\nBadTLP 2\nBadDLLP 0\nTOTAL_ERR_COR 5\n", 5, map[string]int{"RxErr": 1, "BadTLP": 2, "BadDLLP": 0}, true},
+		// older kernels, total is the sum
+		{"without total", "RxErr 1\nBadTLP 2\n", 3, map[string]int{"RxErr": 1, "BadTLP": 2}, true},
+		{"only total", "TOTAL_ERR_COR 4\n", 4, map[string]int{}, true},
+		{"malformed lines", "RxErr 1\nBadTLP two\nTimeout\nRollover 1 2\n\n  Undefined   3  \n", 4, map[string]int{"RxErr": 1, "Undefined": 3}, true},
+		{"total of another type", "TOTAL_ERR_FATAL 1\n", 1, map[string]int{"TOTAL_ERR_FATAL": 1}, true},
+		{"empty", "", 0, nil, false},
+		{"garbage", "no counters here\n", 0, nil, false},
+	}
+	for _, tt := range tests {
+		got, err := parseAerCounters([]byte(tt.data), "TOTAL_ERR_COR")
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if tt.ok && (got.Total != tt.total || !reflect.DeepEqual(got.Errors, tt.errs)) {
+			t.Errorf("%s: got %+v, want total %d, errors %v", tt.name, got, tt.total, tt.errs)
+		}
+	}
+}
+
+func TestPciBridgesInPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want []string
+	}{
+		// GPU behind a switch, nearest bridge first
+		{"/sys/devices/pci0000:40/0000:40:01.1/0000:41:00.0/0000:42:08.0/0000:46:00.0",
+			[]string{"0000:42:08.0", "0000:41:00.0", "0000:40:01.1"}},
+		// directly on a root port
+		{"/sys/devices/pci0000:00/0000:00:01.0/0000:01:00.0", []string{"0000:00:01.0"}},
+		{"/sys/devices/pci0000:00/0000:00:02.0", nil},
+		// PCI domains beyond 0000 (VMD)
+		{"/sys/devices/pci0000:00/0000:00:0e.0/pci10000:00/10000:00:02.0/10000:01:00.0", []string{"10000:00:02.0"}},
+	}
+	for _, tt := range tests {
+		if got := pciBridgesInPath(tt.path); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+// config space with a power management capability at 0x40 and PCI Express at 0x60
+func testPciConfig(portType byte) []byte {
+	config := make([]byte, 256)
+	config[0x34] = 0x40
+	config[0x40], config[0x41] = 0x01, 0x60
+	config[0x60], config[0x62] = 0x10, portType<<4|0x2
+	return config
+}
+
+func TestPciePortType(t *testing.T) {
+	if got := pciePortType(testPciConfig(pciePortSwitchUpstream)); got != pciePortSwitchUpstream {
+		t.Errorf("got %d, want %d", got, pciePortSwitchUpstream)
+	}
+	// header only, as read without CAP_SYS_ADMIN
+	if got := pciePortType(testPciConfig(pciePortEndpoint)[:64]); got != -1 {
+		t.Errorf("header only: got %d", got)
+	}
+	// no PCI Express capability, looping list
+	config := testPciConfig(pciePortEndpoint)
+	config[0x60], config[0x61] = 0x05, 0x40
+	if got := pciePortType(config); got != -1 {
+		t.Errorf("no PCIe capability: got %d", got)
+	}
+	if got := pciePortType(nil); got != -1 {
+		t.Errorf("empty: got %d", got)
+	}
+}
+
+func TestPciLinks(t *testing.T) {
+	link := func(portType int) PciLinkInfo {
+		return PciLinkInfo{CurrentSpeed: 16, MaxSpeed: 16, CurrentWidth: 16, MaxWidth: 16, PortType: portType}
+	}
+	tests := []struct {
+		name  string
+		path  []string
+		links map[string]PciLinkInfo
+		want  [][2]string
+	}{
+		{"switch", []string{"gpu", "dsp", "usp", "rp"},
+			map[string]PciLinkInfo{"gpu": link(pciePortEndpoint), "dsp": link(pciePortSwitchDownstream), "usp": link(pciePortSwitchUpstream), "rp": link(pciePortRootPort)},
+			[][2]string{{"gpu", "dsp"}, {"usp", "rp"}}},
+		// a bridge that is not a switch port shifts the alternation
+		{"non-switch bridge", []string{"gpu", "bridge", "dsp", "usp", "rp"},
+			map[string]PciLinkInfo{"gpu": link(pciePortEndpoint), "bridge": link(pciePortPcieToPciBridge), "dsp": link(pciePortSwitchDownstream), "usp": link(pciePortSwitchUpstream), "rp": link(pciePortRootPort)},
+			[][2]string{{"gpu", "bridge"}, {"bridge", "dsp"}, {"usp", "rp"}}},
+		// bridges without link state (no PCIe capability) are skipped, but are still the parent
+		{"bridge without link", []string{"gpu", "rp", "host"},
+			map[string]PciLinkInfo{"gpu": link(pciePortEndpoint), "rp": link(pciePortRootPort)},
+			[][2]string{{"gpu", "rp"}}},
+		{"unknown port types", []string{"gpu", "dsp", "usp", "rp"},
+			map[string]PciLinkInfo{"gpu": link(-1), "dsp": link(-1), "usp": link(-1), "rp": link(-1)},
+			[][2]string{{"gpu", "dsp"}, {"usp", "rp"}}},
+		{"directly on root port", []string{"gpu", "rp"},
+			map[string]PciLinkInfo{"gpu": link(pciePortEndpoint), "rp": link(pciePortRootPort)},
+			[][2]string{{"gpu", "rp"}}},
+		{"no link state", []string{"gpu", "rp"}, map[string]PciLinkInfo{}, nil},
+	}
+	for _, tt := range tests {
+		if got := pciLinks(tt.path, tt.links); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPciLinkDegraded(t *testing.T) {
+	gen4x16 := PciLinkInfo{CurrentSpeed: 16, MaxSpeed: 16, CurrentWidth: 16, MaxWidth: 16}
+	gen3x16 := PciLinkInfo{CurrentSpeed: 8, MaxSpeed: 8, CurrentWidth: 16, MaxWidth: 16}
+	gen4x8 := PciLinkInfo{CurrentSpeed: 16, MaxSpeed: 16, CurrentWidth: 8, MaxWidth: 16}
+	tests := []struct {
+		name          string
+		child, parent PciLinkInfo
+		want          bool
+	}{
+		{"full", gen4x16, gen4x16, false},
+		// limited by the parent
+		{"gen3 parent", PciLinkInfo{CurrentSpeed: 8, MaxSpeed: 16, CurrentWidth: 16, MaxWidth: 16}, gen3x16, false},
+		{"narrow", gen4x8, gen4x16, true},
+		{"slow", PciLinkInfo{CurrentSpeed: 8, MaxSpeed: 16, CurrentWidth: 16, MaxWidth: 16}, gen4x16, true},
+		{"unknown parent", gen4x8, PciLinkInfo{}, true},
+	}
+	for _, tt := range tests {
+		if got := pciLinkDegraded(tt.child, tt.parent); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/common/log"
+)
+
+// PCI vendor/device names from pci.ids (https://pci-ids.ucw.cz), all ids are lowercase hex
+
+type PciIdsDevice struct {
+	Name       string
+	Subsystems map[string]string // by "<subvendor> <subdevice>"
+}
+
+type PciIdsVendor struct {
+	Name    string
+	Devices map[string]*PciIdsDevice
+}
+
+type PciIds map[string]*PciIdsVendor // by vendor id
+
+// set by pciids_embed.go when built with -tags embed_pciids
+var embeddedPciIds []byte
+
+// loaded on first use and when the path is changed in the config, collectors run concurrently
+var pciIdsMutex sync.Mutex
+var pciIds PciIds
+var pciIdsLoadedPath string
+var pciIdsGeneration int // incremented on every load, names resolved with an older one are outdated
+
+func currentPciIds() PciIds {
+	ids, _ := currentPciIdsGeneration()
+	return ids
+}
+
+func currentPciIdsGeneration() (PciIds, int) {
+	pciIdsMutex.Lock()
+	defer pciIdsMutex.Unlock()
+	if path := currentConfig().Sources.PciIdsPath; pciIds == nil || path != pciIdsLoadedPath {
+		pciIds = loadPciIds(path)
+		pciIdsLoadedPath = path
+		pciIdsGeneration++
+	}
+	return pciIds, pciIdsGeneration
+}
+
+func parsePciIds(data []byte) PciIds {
+	result := make(PciIds)
+	vendorRe := regexp.MustCompile(`^([0-9a-f]{4})\s+(.+)$`)
+	deviceRe := regexp.MustCompile(`^\t([0-9a-f]{4})\s+(.+)$`)
+	subsystemRe := regexp.MustCompile(`^\t\t([0-9a-f]{4}) ([0-9a-f]{4})\s+(.+)$`)
+
+	var vendor *PciIdsVendor
+	var device *PciIdsDevice
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if strings.HasPrefix(line, "C ") {
+			// device classes follow, not needed
+			break
+		}
+		if m := subsystemRe.FindStringSubmatch(line); m != nil {
+			if device != nil {
+				device.Subsystems[m[1]+" "+m[2]] = m[3]
+			}
+		} else if m := deviceRe.FindStringSubmatch(line); m != nil {
+			if vendor != nil {
+				device = &PciIdsDevice{Name: m[2], Subsystems: make(map[string]string)}
+				vendor.Devices[m[1]] = device
+			}
+		} else if m := vendorRe.FindStringSubmatch(line); m != nil {
+			vendor = &PciIdsVendor{Name: m[2], Devices: make(map[string]*PciIdsDevice)}
+			device = nil
+			result[m[1]] = vendor
+		}
+	}
+	return result
+}
+
+func loadPciIds(path string) PciIds {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if embeddedPciIds == nil {
+			log.Errorln("Cannot read pci.ids, PCI names will not be resolved:", err)
+			return make(PciIds)
+		}
+		data = embeddedPciIds
+	}
+	return parsePciIds(data)
+}
+
+// names are formatted like lspci does
+func (ids PciIds) vendorName(vendor string) string {
+	if v, ok := ids[vendor]; ok {
+		return v.Name
+	}
+	return "Vendor " + vendor
+}
+
+func (ids PciIds) deviceName(vendor, device string) string {
+	if v, ok := ids[vendor]; ok {
+		if d, ok := v.Devices[device]; ok {
+			return d.Name
+		}
+	}
+	return "Device " + device
+}
+
+func (ids PciIds) subsystemName(vendor, device, subVendor, subDevice string) string {
+	if v, ok := ids[vendor]; ok {
+		if d, ok := v.Devices[device]; ok {
+			if name, ok := d.Subsystems[subVendor+" "+subDevice]; ok {
+				return name
+			}
+		}
+	}
+	return "Device " + subDevice
+}
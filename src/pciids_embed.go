@@ -0,0 +1,15 @@
+//go:build embed_pciids
+// +build embed_pciids
+
+package main
+
+import _ "embed"
+
+// pci.ids is copied from the file given by `make EMBED_PCIIDS=<path>`
+
+//go:embed pci.ids
+var pciIdsData []byte
+
+func init() {
+	embeddedPciIds = pciIdsData
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+const testPciIds = `# comment
+#	1234  commented device
+10de  NVIDIA Corporation
+	2204  GA102 [GeForce RTX 3090]
+		10de 147d  GA102 [GeForce RTX 3090 Founders Edition]
+		1043 87b3  ROG STRIX RTX 3090
+	# comment between devices
+	2684  AD102 [GeForce RTX 4090]
+15b3  Mellanox Technologies
+	101d  MT2892 Family [ConnectX-6 Dx]
+
+C 03  Display controller
+	00  VGA compatible controller
+		00  VGA controller
+ffff  Illegal Vendor ID
+`
+
+func TestParsePciIds(t *testing.T) {
+	ids := parsePciIds([]byte(testPciIds))
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"vendor", ids.vendorName("10de"), "NVIDIA Corporation"},
+		{"second vendor", ids.vendorName("15b3"), "Mellanox Technologies"},
+		{"device", ids.deviceName("10de", "2204"), "GA102 [GeForce RTX 3090]"},
+		{"device after comment", ids.deviceName("10de", "2684"), "AD102 [GeForce RTX 4090]"},
+		{"device of second vendor", ids.deviceName("15b3", "101d"), "MT2892 Family [ConnectX-6 Dx]"},
+		{"subsystem", ids.subsystemName("10de", "2204", "10de", "147d"), "GA102 [GeForce RTX 3090 Founders Edition]"},
+		{"subsystem of other vendor", ids.subsystemName("10de", "2204", "1043", "87b3"), "ROG STRIX RTX 3090"},
+		// lspci-style names for unknown ids
+		{"unknown vendor", ids.vendorName("1234"), "Vendor 1234"},
+		{"unknown device", ids.deviceName("10de", "1234"), "Device 1234"},
+		{"device of unknown vendor", ids.deviceName("1234", "2204"), "Device 2204"},
+		{"unknown subsystem", ids.subsystemName("10de", "2684", "10de", "167c"), "Device 167c"},
+		// class sections are not read
+		{"after class section", ids.vendorName("ffff"), "Vendor ffff"},
+		{"class", ids.vendorName("03"), "Vendor 03"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+	if len(ids) != 2 || len(ids["10de"].Devices) != 2 {
+		t.Errorf("parsed %d vendors: %v", len(ids), ids)
+	}
+	if len(parsePciIds(nil)) != 0 {
+		t.Error("empty file: vendors parsed")
+	}
+}
+
+func TestVendorInfoFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pciids_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prevConfig := currentConfig()
+	defer setConfig(prevConfig)
+	cfg := *prevConfig
+	cfg.Sources.PciIdsPath = writeTestFile(t, dir, "pci.ids", testPciIds)
+	setConfig(&cfg)
+
+	want := VendorInfo{"NVIDIA Corporation", "GA102 [GeForce RTX 3090]", "NVIDIA Corporation", "GA102 [GeForce RTX 3090 Founders Edition]"}
+	// ids of a device that does not exist in sysfs, as printed by older and current nvidia-smi
+	for _, ids := range [][2]string{{"220410DE", "147D10DE"}, {"0x220410DE", "0x147D10DE"}} {
+		if got := vendorInfo("0000ffff:ff:1f.7", ids[0], ids[1]); got != want {
+			t.Errorf("%v: %+v, want %+v", ids, got, want)
+		}
+	}
+	if got := vendorInfo("0000ffff:ff:1f.7", "N/A", "N/A"); got != (VendorInfo{}) {
+		t.Errorf("N/A: %+v", got)
+	}
+
+	// names are resolved again after another pci.ids is configured
+	core := &OutputData{}
+	core.nvidiaSmiOutput.GPU = []NvidiaSmiGpu{{Id: "0000ffff:ff:1f.7"}}
+	core.nvidiaSmiOutput.GPU[0].PCI.DeviceId = "0x220410DE"
+	c := &pciInfoCollector{}
+	if _, err := c.Update(context.Background(), core); err != nil {
+		t.Fatal(err)
+	}
+	cfg2 := cfg
+	cfg2.Sources.PciIdsPath = writeTestFile(t, dir, "pci2.ids", "10de  NVIDIA\n\t2204  GA102\n")
+	setConfig(&cfg2)
+	store, err := c.Update(context.Background(), core)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data OutputData
+	store(&data)
+	if got := data.vendorInfo["0000ffff:ff:1f.7"]; got.Vendor != "NVIDIA" || got.Device != "GA102" {
+		t.Errorf("after reload: %+v", got)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -23,7 +24,18 @@ type ProcessInfo struct {
 	containerStartTs float64
 }
 
-func processInfo(pid int64) ProcessInfo {
+func (p ProcessInfo) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ProcessName      string  `json:"process_name"`
+		ProcessStartTs   float64 `json:"process_start_timestamp"`
+		ContainerId      string  `json:"container_id,omitempty"`
+		ContainerName    string  `json:"container_name,omitempty"`
+		DockerImage      string  `json:"docker_image,omitempty"`
+		ContainerStartTs float64 `json:"container_start_timestamp,omitempty"`
+	}{p.processName, p.processStartTs, p.containerId, p.containerName, p.dockerImage, p.containerStartTs})
+}
+
+func processInfo(ctx context.Context, pid int64) ProcessInfo {
 	var info ProcessInfo
 	if t, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid)); err == nil {
 		info.processName = t
@@ -31,7 +43,7 @@ func processInfo(pid int64) ProcessInfo {
 	info.processStartTs = processStartTimestamp(pid)
 
 	if cid := containerIdForProcess(pid); cid != "" {
-		if err := dockerInspect(cid, &info); err != nil {
+		if err := dockerInspect(ctx, cid, &info); err != nil {
 			log.Errorln("Docker inspect:", err)
 		}
 	}
@@ -51,7 +63,7 @@ func containerIdForProcess(pid int64) string {
 
 var cli *client.Client
 
-func dockerInspect(cid string, pinfo *ProcessInfo) error {
+func dockerInspect(ctx context.Context, cid string, pinfo *ProcessInfo) error {
 	if cli == nil {
 		var err error
 		cli, err = client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
@@ -59,7 +71,7 @@ func dockerInspect(cid string, pinfo *ProcessInfo) error {
 			return err
 		}
 	}
-	ctJson, err := cli.ContainerInspect(context.Background(), cid)
+	ctJson, err := cli.ContainerInspect(ctx, cid)
 	if err != nil {
 		return err
 	}
@@ -93,3 +105,26 @@ func processStartTimestamp(pid int64) float64 {
 	}
 	return 0
 }
+
+func init() {
+	registerCollector("process", true, "process names and start times from /proc, containers from docker", "process_(start_timestamp|container_start_timestamp|info)", &processCollector{})
+}
+
+type processCollector struct{}
+
+// processes that exited must not be reported after a failed run
+func (c *processCollector) volatile() {}
+
+func (c *processCollector) Update(ctx context.Context, core *OutputData) (func(*OutputData), error) {
+	processes := make(map[int64]ProcessInfo)
+	for _, gpu := range core.nvidiaSmiOutput.GPU {
+		for _, process := range gpu.Processes.ProcessInfo {
+			if _, ok := processes[process.Pid]; !ok {
+				processes[process.Pid] = processInfo(ctx, process.Pid)
+			}
+		}
+	}
+	return func(data *OutputData) {
+		data.processInfo = processes
+	}, nil
+}
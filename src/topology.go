@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// static placement of a GPU in the system, from sysfs
+type PciTopology struct {
+	NumaNode     int // -1 if unknown
+	LocalCpuList string
+	IommuGroup   string
+	Bridges      []VendorInfo // names of pciBridges, in the same order
+}
+
+// one cell of the `nvidia-smi topo -m` matrix
+type TopologyLink struct {
+	PeerId   string // GPU Id or NIC name (mlx5_0)
+	PeerType string // gpu or nic
+	LinkType string // SYS, NODE, PHB, PXB, PIX, NV#
+}
+
+func pciTopology(id string, bridges []string) PciTopology {
+	result := PciTopology{NumaNode: -1}
+	path := sysfsPciPath(id)
+
+	if t, err := ioutil.ReadFile(path + "numa_node"); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(t))); err == nil {
+			result.NumaNode = n
+		}
+	}
+	if t, err := ioutil.ReadFile(path + "local_cpulist"); err == nil {
+		result.LocalCpuList = strings.TrimSpace(string(t))
+	}
+	if t, err := os.Readlink(path + "iommu_group"); err == nil {
+		result.IommuGroup = filepath.Base(t)
+	}
+	for _, bridge := range bridges {
+		result.Bridges = append(result.Bridges, vendorInfo(bridge, "", ""))
+	}
+	return result
+}
+
+// gpuIds are in nvidia-smi order, so GPU<n> in the matrix is gpuIds[n]
+func readNvidiaSmiTopology(ctx context.Context, gpuIds []string) (map[string][]TopologyLink, error) {
+	stdout, err := runNvidiaSmi(ctx, *testTopoFile, "topo", "-m")
+	if err != nil || stdout == nil {
+		return nil, err
+	}
+	result, err := parseNvidiaSmiTopology(stdout, gpuIds)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing nvidia-smi topo output: %v", err)
+	}
+	return result, nil
+}
+
+func parseNvidiaSmiTopology(data []byte, gpuIds []string) (map[string][]TopologyLink, error) {
+	// newer versions underline the header with escape sequences even when not on a tty
+	text := regexp.MustCompile("\x1b\\[[0-9;]*m").ReplaceAllString(string(data), "")
+	lines := strings.Split(text, "\n")
+
+	nicNames := make(map[string]string)
+	for _, line := range lines {
+		if m := regexp.MustCompile(`^\s*(NIC\d+):\s*(\S+)`).FindStringSubmatch(line); m != nil {
+			nicNames[m[1]] = m[2]
+		}
+	}
+	peer := func(name string) (string, string, bool) {
+		if m := regexp.MustCompile(`^GPU(\d+)$`).FindStringSubmatch(name); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			if n < len(gpuIds) {
+				return gpuIds[n], "gpu", true
+			}
+		} else if strings.HasPrefix(name, "NIC") {
+			if nic, ok := nicNames[name]; ok {
+				return nic, "nic", true
+			}
+			return name, "nic", true
+		}
+		return "", "", false
+	}
+
+	var header []string
+	result := make(map[string][]TopologyLink)
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			if header != nil {
+				// end of matrix, legend follows
+				break
+			}
+			continue
+		}
+		cells := strings.Split(line, "\t")
+		for i := range cells {
+			cells[i] = strings.TrimSpace(cells[i])
+		}
+		if header == nil {
+			header = cells
+			continue
+		}
+		id, peerType, ok := peer(cells[0])
+		if !ok || peerType != "gpu" {
+			continue
+		}
+		for i := 1; i < len(cells) && i < len(header); i++ {
+			peerId, peerType, ok := peer(header[i])
+			if !ok || cells[i] == "X" || cells[i] == "" {
+				continue
+			}
+			result[id] = append(result[id], TopologyLink{peerId, peerType, cells[i]})
+		}
+	}
+	if header == nil {
+		return nil, fmt.Errorf("no topology matrix found")
+	}
+	return result, nil
+}
+
+func init() {
+	registerCollector("topology", true, "GPU/NIC link matrix from `nvidia-smi topo -m`", "topology_link_info", &topologyCollector{})
+}
+
+// the matrix only changes when GPUs are added or removed
+type topologyCollector struct {
+	gpuIds   string
+	topology map[string][]TopologyLink
+}
+
+func (c *topologyCollector) Update(ctx context.Context, core *OutputData) (func(*OutputData), error) {
+	gpuIds := make([]string, 0, len(core.nvidiaSmiOutput.GPU))
+	for _, gpu := range core.nvidiaSmiOutput.GPU {
+		gpuIds = append(gpuIds, gpu.Id)
+	}
+	if ids := strings.Join(gpuIds, ","); ids != c.gpuIds {
+		topology, err := readNvidiaSmiTopology(ctx, gpuIds)
+		if err != nil {
+			return nil, err
+		}
+		c.gpuIds = ids
+		c.topology = topology
+	}
+	topology := c.topology
+	return func(data *OutputData) {
+		data.topology = topology
+	}, nil
+}
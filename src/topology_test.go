@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+)
+
+var topologyGpuIds = []string{"00000000:46:00.0", "00000000:81:00.0", "00000000:C1:00.0", "00000000:C2:00.0"}
+
+func TestParseNvidiaSmiTopology(t *testing.T) {
+	data, err := ioutil.ReadFile("../test-files/topo-4-geforce-rtx-3090.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	topology, err := parseNvidiaSmiTopology(data, topologyGpuIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		gpuId    string
+		peerId   string
+		peerType string
+		linkType string
+	}{
+		{"00000000:46:00.0", "00000000:81:00.0", "gpu", "NODE"},
+		{"00000000:46:00.0", "mlx5_0", "nic", "NODE"},
+		{"00000000:81:00.0", "mlx5_0", "nic", "PHB"},
+		{"00000000:C1:00.0", "00000000:C2:00.0", "gpu", "NV4"},
+		{"00000000:C2:00.0", "00000000:C1:00.0", "gpu", "NV4"},
+		{"00000000:C2:00.0", "00000000:46:00.0", "gpu", "NODE"},
+	}
+	for _, tt := range tests {
+		found := false
+		for _, link := range topology[tt.gpuId] {
+			if link.PeerId == tt.peerId {
+				found = true
+				if link.PeerType != tt.peerType || link.LinkType != tt.linkType {
+					t.Errorf("%s -> %s: %s %s, want %s %s", tt.gpuId, tt.peerId, link.PeerType, link.LinkType, tt.peerType, tt.linkType)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("%s -> %s: missing", tt.gpuId, tt.peerId)
+		}
+	}
+
+	// 3 other GPUs and the NIC, no self link, CPU/NUMA affinity columns skipped
+	for _, gpuId := range topologyGpuIds {
+		if n := len(topology[gpuId]); n != 4 {
+			t.Errorf("%s: %d links, want 4: %v", gpuId, n, topology[gpuId])
+		}
+	}
+	if _, ok := topology["mlx5_0"]; ok {
+		t.Error("NIC rows must not be exported as GPUs")
+	}
+}
+
+func TestParseNvidiaSmiTopologyEscapes(t *testing.T) {
+	data := "\x1b[4m\tGPU0\tGPU1\tCPU Affinity\x1b[0m\nGPU0\t X \tSYS\t0-7\nGPU1\tSYS\t X \t8-15\n"
+	topology, err := parseNvidiaSmiTopology([]byte(data), topologyGpuIds[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if links := topology["00000000:46:00.0"]; len(links) != 1 || links[0] != (TopologyLink{"00000000:81:00.0", "gpu", "SYS"}) {
+		t.Errorf("got %v", links)
+	}
+	if _, err := parseNvidiaSmiTopology([]byte("\n"), topologyGpuIds); err == nil {
+		t.Error("expected an error for output without a matrix")
+	}
+}
+
+// a failed `nvidia-smi topo -m` must not be cached for the GPU set
+func TestTopologyCollectorRetriesAfterError(t *testing.T) {
+	defer func() { *testTopoFile = "" }()
+	core := &OutputData{}
+	for _, id := range topologyGpuIds {
+		core.nvidiaSmiOutput.GPU = append(core.nvidiaSmiOutput.GPU, NvidiaSmiGpu{Id: id})
+	}
+	c := &topologyCollector{}
+
+	*testTopoFile = "../test-files/does-not-exist.txt"
+	if _, err := c.Update(context.Background(), core); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+
+	*testTopoFile = "../test-files/topo-4-geforce-rtx-3090.txt"
+	store, err := c.Update(context.Background(), core)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data OutputData
+	store(&data)
+	if len(data.topology) != 4 {
+		t.Errorf("topology not read again after the error, got %v", data.topology)
+	}
+}
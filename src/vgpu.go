@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type Vgpu struct {
+	Id     string
+	Fields map[string]string // by key path, e.g. "FB Memory Usage/Used"
+}
+
+type VgpuHost struct {
+	ActiveVgpus string
+	Vgpus       []*Vgpu
+}
+
+type VgpuInfo map[string]*VgpuHost // by GPU Id
+
+// Parse `nvidia-smi vgpu -q` output, nesting is given by indentation:
+//
+//	GPU 00000000:01:00.0
+//	    Active vGPUs                          : 1
+//	    vGPU ID                               : 3251634177
+//	        VM Name                           : render-vm-01
+//	        FB Memory Usage
+//	            Used                          : 1533 MiB
+func parseVgpuOutput(data []byte) (VgpuInfo, error) {
+	result := make(VgpuInfo)
+	gpuRe := regexp.MustCompile(`^GPU ([0-9A-Fa-f]+:[0-9A-Fa-f]+:[0-9A-Fa-f]+\.[0-9A-Fa-f]+)\s*$`)
+
+	type section struct {
+		indent int
+		name   string
+	}
+	var host *VgpuHost
+	var vgpu *Vgpu
+	var sections []section
+	for _, line := range strings.Split(string(data), "\n") {
+		if m := gpuRe.FindStringSubmatch(line); m != nil {
+			host = &VgpuHost{}
+			result[m[1]] = host
+			vgpu = nil
+			sections = nil
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		if host == nil || trimmed == "" {
+			// header before the first GPU
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " \t"))
+		for len(sections) > 0 && sections[len(sections)-1].indent >= indent {
+			sections = sections[:len(sections)-1]
+		}
+
+		i := strings.Index(trimmed, ":")
+		if i < 0 {
+			sections = append(sections, section{indent, trimmed})
+			continue
+		}
+		key := strings.TrimSpace(trimmed[:i])
+		value := strings.TrimSpace(trimmed[i+1:])
+		switch {
+		case key == "Active vGPUs" && len(sections) == 0:
+			host.ActiveVgpus = value
+		case key == "vGPU ID" && len(sections) == 0:
+			vgpu = &Vgpu{Id: value, Fields: make(map[string]string)}
+			host.Vgpus = append(host.Vgpus, vgpu)
+		case vgpu != nil:
+			for j := len(sections) - 1; j >= 0; j-- {
+				key = sections[j].name + "/" + key
+			}
+			vgpu.Fields[key] = value
+		default:
+			return nil, fmt.Errorf("vGPU field before vGPU ID: %q", line)
+		}
+	}
+	return result, nil
+}
+
+func readVgpuInfo(ctx context.Context) (VgpuInfo, error) {
+	stdout, err := runNvidiaSmi(ctx, *testVgpuFile, "vgpu", "-q")
+	if err != nil {
+		return nil, fmt.Errorf("nvidia-smi vgpu -q: %v", err)
+	}
+	return parseVgpuOutput(stdout)
+}
+
+func init() {
+	registerCollector("vgpu", true, "vGPU instances from `nvidia-smi vgpu -q` (only on vGPU hosts)", "vgpu_.*", &vgpuCollector{})
+}
+
+type vgpuCollector struct{}
+
+func (c *vgpuCollector) Update(ctx context.Context, core *OutputData) (func(*OutputData), error) {
+	// vGPUs only exist on hypervisors running the vGPU manager
+	hostVgpu := *testVgpuFile != ""
+	for _, gpu := range core.nvidiaSmiOutput.GPU {
+		hostVgpu = hostVgpu || gpu.GPUVirtualizationMode.VirtualizationMode == "Host VGPU"
+	}
+	var info VgpuInfo
+	if hostVgpu {
+		var err error
+		if info, err = readVgpuInfo(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return func(data *OutputData) {
+		data.vgpuInfo = info
+	}, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseVgpuOutput(t *testing.T) {
+	data, err := ioutil.ReadFile("../test-files/vgpu-tesla-t4.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := parseVgpuOutput(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, ok := info["00000000:01:00.0"]
+	if !ok {
+		t.Fatalf("GPU 00000000:01:00.0 missing, got %v", info)
+	}
+	if host.ActiveVgpus != "2" || len(host.Vgpus) != 2 {
+		t.Fatalf("got %s active vGPUs and %d vGPUs, want 2", host.ActiveVgpus, len(host.Vgpus))
+	}
+
+	tests := []struct {
+		id     string
+		fields map[string]string
+	}{
+		{
+			id: "3251634177",
+			fields: map[string]string{
+				"VM Name":                       "render-vm-01",
+				"VM UUID":                       "4c1c2f6e-5b1d-4bd4-9b4f-1d8e0c3a7f21",
+				"vGPU UUID":                     "7e1d6c7a-1f35-11ef-9d4e-0cc47a8b2f10",
+				"vGPU Name":                     "GRID T4-4Q",
+				"License Status":                "Licensed (Expiry: 2024-12-31 23:59:59 GMT)",
+				"PCI/Bus Id":                    "00000000:02:01.0",
+				"FB Memory Usage/Total":         "4096 MiB",
+				"FB Memory Usage/Used":          "1533 MiB",
+				"FB Memory Usage/Free":          "2563 MiB",
+				"Utilization/Encoder":           "4 %",
+				"Encoder Stats/Active Sessions": "1",
+				"Encoder Stats/Average FPS":     "59",
+				"Encoder Stats/Average Latency": "3124",
+				"FBC Stats/Active Sessions":     "0",
+				"Frame Rate Limit":              "60 FPS",
+			},
+		},
+		{
+			id: "3251634178",
+			fields: map[string]string{
+				"VM Name":                       "render-vm-02",
+				"Guest Driver Version":          "N/A",
+				"License Status":                "Unlicensed (Restricted)",
+				"FB Memory Usage/Used":          "412 MiB",
+				"Encoder Stats/Active Sessions": "0",
+			},
+		},
+	}
+	for i, tt := range tests {
+		vgpu := host.Vgpus[i]
+		if vgpu.Id != tt.id {
+			t.Errorf("vGPU %d: id %s, want %s", i, vgpu.Id, tt.id)
+		}
+		for key, value := range tt.fields {
+			if vgpu.Fields[key] != value {
+				t.Errorf("vGPU %s: %q is %q, want %q", tt.id, key, vgpu.Fields[key], value)
+			}
+		}
+	}
+}
+
+func TestParseVgpuOutputFieldBeforeId(t *testing.T) {
+	_, err := parseVgpuOutput([]byte("GPU 00000000:01:00.0\n    VM Name : vm\n"))
+	if err == nil {
+		t.Error("expected an error for a vGPU field before the vGPU ID")
+	}
+}
+
+func TestWriteVgpuMetrics(t *testing.T) {
+	data, err := ioutil.ReadFile("../test-files/vgpu-tesla-t4.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := parseVgpuOutput(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	writeVgpuMetrics(w, &OutputData{vgpuInfo: info}, map[string]string{"gpu_id": "01:00.0"}, "00000000:01:00.0")
+	output := w.Body.String()
+
+	for _, line := range []string{
+		`nvidiasmi_vgpu_active_count{gpu_id="01:00.0"} 2`,
+		`nvidiasmi_vgpu_licensed{gpu_id="01:00.0",vgpu_id="3251634177"} 1`,
+		`nvidiasmi_vgpu_licensed{gpu_id="01:00.0",vgpu_id="3251634178"} 0`,
+		`nvidiasmi_vgpu_fb_memory_usage_used_bytes{gpu_id="01:00.0",vgpu_id="3251634177"} 1.607467008e+09`,
+		`nvidiasmi_vgpu_engine_utilization_percent{engine="encoder",gpu_id="01:00.0",vgpu_id="3251634177"} 4`,
+		`nvidiasmi_vgpu_encoder_session_count{gpu_id="01:00.0",vgpu_id="3251634177"} 1`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("missing %s in\n%s", line, output)
+		}
+	}
+	if !strings.Contains(output, `vm_name="render-vm-01"`) {
+		t.Errorf("vgpu_info without vm_name in\n%s", output)
+	}
+}
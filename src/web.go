@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+Web config file as used by Prometheus exporters (exporter-toolkit), plus bearer tokens:
+
+tls_server_config:
+  cert_file: /etc/nvidiasmi_exporter/tls.crt
+  key_file: /etc/nvidiasmi_exporter/tls.key
+  client_auth_type: RequireAndVerifyClientCert
+  client_ca_file: /etc/nvidiasmi_exporter/ca.crt
+  min_version: TLS12
+basic_auth_users:
+  prometheus: $2y$10$...   # bcrypt hash, e.g. from htpasswd -nBC 10 prometheus
+bearer_tokens:
+  - secret-token
+*/
+
+type WebConfig struct {
+	TLSServerConfig *TLSServerConfig  `yaml:"tls_server_config"`
+	BasicAuthUsers  map[string]string `yaml:"basic_auth_users"` // bcrypt hashes by user name
+	BearerTokens    []string          `yaml:"bearer_tokens"`
+
+	tlsConfig *tls.Config
+
+	// successful basic auth checks, bcrypt is slow on purpose
+	authCacheMutex sync.Mutex
+	authCache      map[[sha256.Size]byte]bool
+}
+
+type TLSServerConfig struct {
+	CertFile       string `yaml:"cert_file"`
+	KeyFile        string `yaml:"key_file"`
+	ClientAuthType string `yaml:"client_auth_type"`
+	ClientCAFile   string `yaml:"client_ca_file"`
+	MinVersion     string `yaml:"min_version"`
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                           tls.NoClientCert,
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+var tlsVersions = map[string]uint16{
+	"":      tls.VersionTLS12,
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// Reads the web config file and the certificates it refers to, empty file name: no TLS and no authentication.
+func loadWebConfig(file string) (*WebConfig, error) {
+	cfg := &WebConfig{authCache: make(map[[sha256.Size]byte]bool)}
+	if file == "" {
+		return cfg, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	for user, hash := range cfg.BasicAuthUsers {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s: basic_auth_users: invalid bcrypt hash for user %q: %v", file, user, err)
+		}
+	}
+	for _, token := range cfg.BearerTokens {
+		if token == "" {
+			return nil, fmt.Errorf("%s: bearer_tokens must not be empty", file)
+		}
+	}
+
+	if tc := cfg.TLSServerConfig; tc != nil {
+		if tc.CertFile == "" || tc.KeyFile == "" {
+			return nil, fmt.Errorf("%s: tls_server_config: cert_file and key_file are required", file)
+		}
+		cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: tls_server_config: %v", file, err)
+		}
+		clientAuth, ok := clientAuthTypes[tc.ClientAuthType]
+		if !ok {
+			return nil, fmt.Errorf("%s: tls_server_config: unknown client_auth_type %q", file, tc.ClientAuthType)
+		}
+		minVersion, ok := tlsVersions[tc.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("%s: tls_server_config: unknown min_version %q", file, tc.MinVersion)
+		}
+		cfg.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   clientAuth,
+			MinVersion:   minVersion,
+		}
+		if tc.ClientCAFile != "" {
+			pem, err := ioutil.ReadFile(tc.ClientCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("%s: tls_server_config: %v", file, err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("%s: tls_server_config: no certificates in %s", file, tc.ClientCAFile)
+			}
+			cfg.tlsConfig.ClientCAs = pool
+		} else if clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert {
+			return nil, fmt.Errorf("%s: tls_server_config: client_ca_file is required for client_auth_type %s", file, tc.ClientAuthType)
+		}
+	}
+
+	return cfg, nil
+}
+
+// compared against for unknown users, so the response time does not tell which users exist
+const dummyPasswordHash = "$2a$10$51JYH/73kFfBX9Yr2pUwau3KwFESF1J0gTAVtWrvtbYFbw3ogy00O"
+
+func (cfg *WebConfig) checkBasicAuth(user, password string) bool {
+	hash, ok := cfg.BasicAuthUsers[user]
+	if !ok {
+		bcrypt.CompareHashAndPassword([]byte(dummyPasswordHash), []byte(password))
+		return false
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + password + "\x00" + hash))
+	cfg.authCacheMutex.Lock()
+	cached := cfg.authCache[key]
+	cfg.authCacheMutex.Unlock()
+	if cached {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+	cfg.authCacheMutex.Lock()
+	cfg.authCache[key] = true
+	cfg.authCacheMutex.Unlock()
+	return true
+}
+
+func (cfg *WebConfig) checkBearerToken(token string) bool {
+	for _, t := range cfg.BearerTokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Requires basic auth or a bearer token if any are configured (either is accepted if both are).
+// Health and readiness checks are always allowed, for probes of orchestrators.
+func authenticate(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := currentConfig().Web
+		open := len(cfg.BasicAuthUsers) == 0 && len(cfg.BearerTokens) == 0
+		if open || r.URL.Path == "/-/healthy" || r.URL.Path == "/-/ready" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if user, password, ok := r.BasicAuth(); ok && cfg.checkBasicAuth(user, password) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") && cfg.checkBearerToken(strings.TrimPrefix(auth, "Bearer ")) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if len(cfg.BasicAuthUsers) > 0 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="nvidiasmi_exporter"`)
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// "unix:/path/to/socket" or host:port, with TLS if configured at startup
+func listen(address string, cfg *WebConfig) (net.Listener, error) {
+	var listener net.Listener
+	var err error
+	if path := strings.TrimPrefix(address, "unix:"); path != address {
+		// left over if the exporter was not shut down cleanly, other files are never removed
+		if fi, err := os.Lstat(path); err == nil {
+			if fi.Mode()&os.ModeSocket == 0 {
+				return nil, fmt.Errorf("%s exists and is not a socket", path)
+			}
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		listener, err = net.Listen("unix", path)
+	} else {
+		listener, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.tlsConfig != nil {
+		// certificates and client CAs are taken from the current config, so they can be reloaded
+		listener = tls.NewListener(listener, &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return currentConfig().Web.tlsConfig, nil
+			},
+		})
+	}
+	return listener, nil
+}
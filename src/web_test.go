@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "web_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a regular file is not removed
+	file := writeTestFile(t, dir, "exporter.sock", "data")
+	if _, err := listen("unix:"+file, &WebConfig{}); err == nil {
+		t.Error("expected an error for a regular file")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("regular file removed: %v", err)
+	}
+
+	// a stale socket is replaced
+	path := filepath.Join(dir, "stale.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	listener, err := listen("unix:"+path, &WebConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+}
+
+func TestCheckBasicAuth(t *testing.T) {
+	cfg := &WebConfig{
+		BasicAuthUsers: map[string]string{"alice": dummyPasswordHash},
+		authCache:      make(map[[32]byte]bool),
+	}
+	if !cfg.checkBasicAuth("alice", "dummy password") || !cfg.checkBasicAuth("alice", "dummy password") {
+		t.Error("valid password rejected")
+	}
+	if cfg.checkBasicAuth("alice", "wrong") || cfg.checkBasicAuth("bob", "dummy password") {
+		t.Error("invalid credentials accepted")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type XidInfo struct {
+	Count       int       // since the exporter started
+	LastMessage string    // e.g. "pid=1234, name=python3, Ch 00000008"
+	LastTime    time.Time // when it was read
+}
+
+type XidErrors map[string]map[int]XidInfo // by GPU Id (short) and Xid
+
+// kernel log line of the NVIDIA driver:
+// NVRM: Xid (PCI:0000:46:00): 79, pid=1234, name=python3, GPU has fallen off the bus.
+var xidRe = regexp.MustCompile(`NVRM: Xid \(PCI:([0-9a-fA-F:.]+)\): (\d+),?\s*(.*)`)
+
+// Adds the Xid errors in the kernel log records to errors
+func parseXidRecords(records []string, now time.Time, errors XidErrors) {
+	for _, record := range records {
+		// /dev/kmsg records are "priority,sequence,timestamp,flags;message"
+		if i := strings.Index(record, ";"); i >= 0 {
+			record = record[i+1:]
+		}
+		m := xidRe.FindStringSubmatch(record)
+		if m == nil {
+			continue
+		}
+		gpuId := shortPciId(m[1])
+		if !strings.Contains(gpuId, ".") {
+			gpuId += ".0"
+		}
+		xid, _ := strconv.Atoi(m[2])
+		if errors[gpuId] == nil {
+			errors[gpuId] = make(map[int]XidInfo)
+		}
+		info := errors[gpuId][xid]
+		info.Count++
+		info.LastMessage = strings.TrimSpace(m[3])
+		info.LastTime = now
+		errors[gpuId][xid] = info
+	}
+}
+
+// Reads the records logged since the last call. Not using os.File, the runtime poller
+// would wait for new records instead of returning at the end.
+func readKmsg(fd int) ([]string, error) {
+	var records []string
+	buf := make([]byte, 8192) // records are at most 8 KiB
+	for {
+		n, err := syscall.Read(fd, buf)
+		switch {
+		case err == syscall.EAGAIN:
+			return records, nil
+		case err == syscall.EPIPE:
+			// records were overwritten before being read
+			continue
+		case err != nil:
+			return records, err
+		case n == 0:
+			return records, nil
+		}
+		records = append(records, string(buf[:n]))
+	}
+}
+
+func init() {
+	registerCollector("xid", false, "NVIDIA Xid errors from the kernel log (/dev/kmsg, needs root or CAP_SYSLOG)", "xid_.*", &xidCollector{fd: -1})
+}
+
+type xidCollector struct {
+	fd         int
+	fileOffset int // with --test-kmsg-file
+	errors     XidErrors
+}
+
+func (c *xidCollector) Update(ctx context.Context, core *OutputData) (func(*OutputData), error) {
+	var records []string
+	if *testKmsgFile != "" {
+		// lines appended since the last run, like new records in /dev/kmsg
+		data, err := ioutil.ReadFile(*testKmsgFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < c.fileOffset {
+			// truncated
+			c.fileOffset = 0
+		}
+		if end := strings.LastIndexByte(string(data), '\n') + 1; end > c.fileOffset {
+			records = strings.Split(string(data[c.fileOffset:end]), "\n")
+			c.fileOffset = end
+		}
+	} else {
+		if c.fd < 0 {
+			fd, err := syscall.Open("/dev/kmsg", syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+			if err != nil {
+				return nil, err
+			}
+			// only errors from now on, older ones may have been handled already
+			if _, err := syscall.Seek(fd, 0, io.SeekEnd); err != nil {
+				syscall.Close(fd)
+				return nil, err
+			}
+			c.fd = fd
+		}
+		var err error
+		if records, err = readKmsg(c.fd); err != nil {
+			return nil, err
+		}
+	}
+
+	// copied, so that snapshots can be compared for new errors
+	errors := make(XidErrors)
+	for gpuId, byXid := range c.errors {
+		errors[gpuId] = make(map[int]XidInfo)
+		for xid, info := range byXid {
+			errors[gpuId][xid] = info
+		}
+	}
+	parseXidRecords(records, time.Now(), errors)
+	c.errors = errors
+	return func(data *OutputData) {
+		data.xidErrors = errors
+	}, nil
+}
+
+func writeXidMetrics(w http.ResponseWriter, labelValues map[string]string, errors map[int]XidInfo) {
+	xids := make([]int, 0, len(errors))
+	for xid := range errors {
+		xids = append(xids, xid)
+	}
+	sort.Ints(xids)
+	for _, xid := range xids {
+		labelValues["xid"] = strconv.Itoa(xid)
+		writeMetric(w, "xid_errors_total", labelValues, strconv.Itoa(errors[xid].Count))
+		writeMetric(w, "xid_last_error_timestamp_seconds", labelValues, strconv.FormatInt(errors[xid].LastTime.Unix(), 10))
+	}
+	delete(labelValues, "xid")
+}